@@ -4,6 +4,10 @@ Copyright © 2024 NAME HERE <EMAIL ADDRESS>
 package cmd
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
@@ -13,8 +17,10 @@ import (
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
 
+	"github.com/azrod/dnsr/internal/admin"
 	"github.com/azrod/dnsr/internal/cache"
 	"github.com/azrod/dnsr/internal/config"
+	"github.com/azrod/dnsr/internal/metrics"
 	"github.com/azrod/dnsr/internal/server"
 )
 
@@ -32,7 +38,7 @@ to quickly create a Cobra application.`,
 		var (
 			sigs   = make(chan os.Signal, 1)
 			ticker *time.Ticker
-			done   = make(chan bool, 1)
+			done   = make(chan bool)
 		)
 
 		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
@@ -42,10 +48,14 @@ to quickly create a Cobra application.`,
 			return
 		}
 
+		// The listeners and background tasks are set up with the configuration read at startup
+		cfg := config.Get()
+
 		config.WatchConfigFile(cfgFile, done)
+		config.WatchHostsFiles(done)
 
-		if config.Cfg.ExternalUpstreamsInterval > 0 {
-			ticker = time.NewTicker(time.Duration(config.Cfg.ExternalUpstreamsInterval) * time.Minute)
+		if cfg.ExternalUpstreamsInterval > 0 {
+			ticker = time.NewTicker(time.Duration(cfg.ExternalUpstreamsInterval) * time.Minute)
 		} else {
 			ticker = time.NewTicker(5 * time.Minute)
 		}
@@ -60,38 +70,163 @@ to quickly create a Cobra application.`,
 			}
 		}()
 
-		srv := &dns.Server{Addr: config.Cfg.Server.GetListenAddress(), Net: "udp"}
-		srv.Handler = &server.DNSHandler{}
+		// The lists are fetched again at the interval of the startup configuration
+		blocklistsTicker := time.NewTicker(cfg.Blocklists.GetInterval())
+		go func() {
+			for {
+				select {
+				case <-blocklistsTicker.C:
+					config.LoadBlocklists()
+				case <-done:
+					blocklistsTicker.Stop()
+					return
+				}
+			}
+		}()
 
-		if config.Cfg.Cache.Enabled {
+		rpzTicker := time.NewTicker(cfg.RPZ.GetRefresh())
+		go func() {
+			for {
+				select {
+				case <-rpzTicker.C:
+					config.LoadRPZ()
+				case <-done:
+					rpzTicker.Stop()
+					return
+				}
+			}
+		}()
+
+		server.StartHealthChecks(done)
+
+		handler := &server.DNSHandler{}
+
+		if cfg.Cache.Enabled {
 			ca, err := cache.New()
 			if err != nil {
 				log.Error().Err(err).Msg("Error creating cache")
+				return
 			}
-			srv.Handler = &server.DNSHandler{Cache: ca}
+			handler.Cache = ca
+			metrics.RegisterCacheSize(ca.Len)
+			metrics.RegisterCacheEvictions(ca.Evictions)
 		}
 
-		log.Info().Msgf("Server listening on %s", config.Cfg.Server.GetListenAddress())
-		go func() {
-			if err := srv.ListenAndServe(); err != nil {
-				log.Error().Err(err).Msg("Error starting the server")
-				// send signal to sigs channel with error
-				sigs <- syscall.SIGINT
+		handler.StartPrefetch(done)
+
+		// Listen on both UDP and TCP, clients retry over TCP when the UDP response is truncated
+		servers := []*dns.Server{
+			{Addr: cfg.Server.GetListenAddress(), Net: "udp", Handler: handler.WithListener(config.ListenerUDP)},
+			{Addr: cfg.Server.GetListenAddress(), Net: "tcp", Handler: handler.WithListener(config.ListenerTCP)},
+		}
+
+		// Encrypted listeners share the same cache
+		if listener := cfg.Server.TLS; listener.Enabled {
+			cert, err := tls.LoadX509KeyPair(listener.CertFile, listener.KeyFile)
+			if err != nil {
+				log.Error().Err(err).Msg("Error loading the DNS-over-TLS certificate")
+				return
 			}
-		}()
+
+			servers = append(servers, &dns.Server{
+				Addr:      cfg.Server.GetTLSListenAddress(),
+				Net:       "tcp-tls",
+				TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12},
+				Handler:   handler.WithListener(config.ListenerTLS),
+			})
+		}
+
+		var httpsServer *http.Server
+		if listener := cfg.Server.HTTPS; listener.Enabled {
+			mux := http.NewServeMux()
+			mux.Handle(listener.GetPath(), &server.DoHHandler{Handler: handler.WithListener(config.ListenerHTTPS)})
+
+			httpsServer = &http.Server{
+				Addr:              cfg.Server.GetHTTPSListenAddress(),
+				Handler:           mux,
+				ReadHeaderTimeout: 10 * time.Second,
+			}
+
+			log.Info().Msgf("Server listening on %s (https%s)", httpsServer.Addr, listener.GetPath())
+			go func() {
+				if err := httpsServer.ListenAndServeTLS(listener.CertFile, listener.KeyFile); err != nil && !errors.Is(err, http.ErrServerClosed) {
+					log.Error().Err(err).Msg("Error starting the https server")
+					// send signal to sigs channel with error
+					sigs <- syscall.SIGINT
+				}
+			}()
+		}
+
+		for _, srv := range servers {
+			log.Info().Msgf("Server listening on %s (%s)", srv.Addr, srv.Net)
+			go func(srv *dns.Server) {
+				if err := srv.ListenAndServe(); err != nil {
+					log.Error().Err(err).Msgf("Error starting the %s server", srv.Net)
+					// send signal to sigs channel with error
+					sigs <- syscall.SIGINT
+				}
+			}(srv)
+		}
+
+		var metricsServer *http.Server
+		if cfg.Metrics.Enabled {
+			metricsServer = metrics.NewServer(cfg.Metrics.GetListenAddress(), cfg.Metrics.GetPath())
+
+			log.Info().Msgf("Metrics listening on %s%s", metricsServer.Addr, cfg.Metrics.GetPath())
+			go func() {
+				if err := metricsServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+					log.Error().Err(err).Msg("Error starting the metrics server")
+					// send signal to sigs channel with error
+					sigs <- syscall.SIGINT
+				}
+			}()
+		}
+
+		var adminServer *http.Server
+		if cfg.Admin.Enabled {
+			var err error
+			adminServer, err = admin.NewServer(cfg.Admin.GetListenAddress(), cfg.Admin.Token, cfgFile, handler.Cache)
+			if err != nil {
+				log.Error().Err(err).Msg("Error creating the admin API")
+				return
+			}
+
+			log.Info().Msgf("Admin API listening on %s", adminServer.Addr)
+			go func() {
+				if err := adminServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+					log.Error().Err(err).Msg("Error starting the admin API")
+					// send signal to sigs channel with error
+					sigs <- syscall.SIGINT
+				}
+			}()
+		}
 
 		<-sigs
 		log.Info().Msg("Received signal to shut down the server")
 
-		// send signal to done channel
-		done <- true
+		// close done channel to stop all the background tasks
+		close(done)
 
-		if err := srv.Shutdown(); err != nil {
-			log.Error().Err(err).Msg("Error shutting down the server")
+		for _, srv := range servers {
+			if err := srv.Shutdown(); err != nil {
+				log.Error().Err(err).Msgf("Error shutting down the %s server", srv.Net)
+			}
+		}
+
+		for name, httpServer := range map[string]*http.Server{"https": httpsServer, "metrics": metricsServer, "admin": adminServer} {
+			if httpServer == nil {
+				continue
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			if err := httpServer.Shutdown(ctx); err != nil {
+				log.Error().Err(err).Msgf("Error shutting down the %s server", name)
+			}
+			cancel()
 		}
 
-		if config.Cfg.Cache.Enabled {
-			if err := cache.PersistCache(srv.Handler.(*server.DNSHandler).Cache); err != nil {
+		if cfg.Cache.Enabled {
+			if err := cache.PersistCache(handler.Cache); err != nil {
 				log.Error().Err(err).Msg("Error persisting cache before shutting down")
 			}
 		}
@@ -0,0 +1,317 @@
+// Admin is a package that holds the HTTP admin API of the application.
+// It replaces the clear/ DNS commands with authenticated endpoints.
+
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rs/zerolog/log"
+
+	"github.com/azrod/dnsr/internal/cache/base"
+	"github.com/azrod/dnsr/internal/config"
+	"github.com/azrod/dnsr/internal/metrics"
+)
+
+// ErrNoToken is returned when the admin API is enabled without a token.
+var ErrNoToken = errors.New("the admin API requires a token")
+
+type (
+	// API is the admin API.
+	API struct {
+		token      string
+		configFile string
+		cache      base.Cache
+	}
+
+	// cacheEntry is a cache entry as returned by the API.
+	cacheEntry struct {
+		Key      string    `json:"key"`
+		Name     string    `json:"name"`
+		Type     string    `json:"type"`
+		Class    string    `json:"class"`
+		Upstream string    `json:"upstream,omitempty"`
+		Rcode    string    `json:"rcode"`
+		Answer   []string  `json:"answer,omitempty"`
+		Ns       []string  `json:"ns,omitempty"`
+		ExpireAt time.Time `json:"expireAt"`
+	}
+
+	// route is a routing rule as returned by the API.
+	route struct {
+		Kind     string   `json:"kind"`
+		Match    string   `json:"match"`
+		Upstream string   `json:"upstream"`
+		Servers  []string `json:"servers"`
+		Strategy string   `json:"strategy"`
+		Priority int      `json:"priority"`
+	}
+
+	// deleted is the response of the delete endpoints.
+	deleted struct {
+		Deleted int `json:"deleted"`
+	}
+
+	// apiError is the response of the failed requests.
+	apiError struct {
+		Error string `json:"error"`
+	}
+)
+
+// NewServer returns the HTTP server of the admin API on the given address.
+// The cache may be nil when the cache is disabled.
+func NewServer(addr, token, configFile string, c base.Cache) (*http.Server, error) {
+	if token == "" {
+		return nil, ErrNoToken
+	}
+
+	a := &API{
+		token:      token,
+		configFile: configFile,
+		cache:      c,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/cache", a.withCache(a.listCache))
+	mux.HandleFunc("DELETE /api/v1/cache", a.withCache(a.flushCache))
+	mux.HandleFunc("GET /api/v1/cache/{name}/{type}", a.withCache(a.getCacheEntry))
+	mux.HandleFunc("DELETE /api/v1/cache/{name}/{type}", a.withCache(a.deleteCacheEntry))
+	mux.HandleFunc("DELETE /api/v1/cache/{name}", a.withCache(a.deleteCacheName))
+	mux.HandleFunc("GET /api/v1/routes", a.listRoutes)
+	mux.HandleFunc("POST /api/v1/upstreams/external/reload", a.reloadExternalUpstreams)
+	mux.HandleFunc("POST /api/v1/config/reload", a.reloadConfig)
+
+	return &http.Server{
+		Addr:              addr,
+		Handler:           a.authenticate(mux),
+		ReadHeaderTimeout: 10 * time.Second,
+	}, nil
+}
+
+// authenticate rejects the requests without the bearer token.
+func (a *API) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+			writeError(w, http.StatusUnauthorized, errors.New("invalid or missing token"))
+			return
+		}
+
+		log.Info().Msgf("Admin API %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withCache rejects the requests when the cache is disabled.
+func (a *API) withCache(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if a.cache == nil {
+			writeError(w, http.StatusNotFound, errors.New("cache not enabled"))
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// listCache returns the cache entries, optionally filtered with the suffix or regex query parameters.
+func (a *API) listCache(w http.ResponseWriter, r *http.Request) {
+	match, err := keyMatcher(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	entries := []cacheEntry{}
+	for _, key := range a.cache.Keys() {
+		if !match(key) {
+			continue
+		}
+
+		// The entries read by the API are not counted as used by the eviction policy and the prefetch
+		if value, err := a.cache.GetEntry(key); err == nil {
+			entries = append(entries, newCacheEntry(key, value))
+		}
+	}
+
+	writeJSON(w, http.StatusOK, entries)
+}
+
+// flushCache deletes the cache entries matching the suffix or regex query parameters,
+// or all the entries without parameters.
+func (a *API) flushCache(w http.ResponseWriter, r *http.Request) {
+	match, err := keyMatcher(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	count := 0
+	for _, key := range a.cache.Keys() {
+		if match(key) && a.cache.Delete(key) == nil {
+			count++
+		}
+	}
+
+	metrics.CacheDeletions.Add(float64(count))
+	writeJSON(w, http.StatusOK, deleted{Deleted: count})
+}
+
+// getCacheEntry returns a single cache entry.
+func (a *API) getCacheEntry(w http.ResponseWriter, r *http.Request) {
+	key, err := pathKey(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	value, err := a.cache.GetEntry(key)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newCacheEntry(key, value))
+}
+
+// deleteCacheEntry deletes a single cache entry.
+func (a *API) deleteCacheEntry(w http.ResponseWriter, r *http.Request) {
+	key, err := pathKey(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	// The answers of the upstreams depending on the client are deleted with the shared answer
+	count := base.DeleteQuestion(a.cache, key)
+	if count == 0 {
+		writeError(w, http.StatusNotFound, base.ErrNotFound)
+		return
+	}
+
+	metrics.CacheDeletions.Add(float64(count))
+	writeJSON(w, http.StatusOK, deleted{Deleted: count})
+}
+
+// deleteCacheName deletes the cache entries of every type of a name.
+func (a *API) deleteCacheName(w http.ResponseWriter, r *http.Request) {
+	size := a.cache.Len()
+	if err := a.cache.DeleteName(r.PathValue("name")); err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+
+	count := size - a.cache.Len()
+	metrics.CacheDeletions.Add(float64(count))
+	writeJSON(w, http.StatusOK, deleted{Deleted: count})
+}
+
+// listRoutes returns the routing table computed from the upstreams, in evaluation order.
+func (a *API) listRoutes(w http.ResponseWriter, _ *http.Request) {
+	routes := []route{}
+	for _, r := range config.Md.Routes() {
+		routes = append(routes, route{
+			Kind:     r.Kind,
+			Match:    r.Pattern,
+			Upstream: r.Upstream.Name,
+			Servers:  r.Upstream.DNSServers,
+			Strategy: r.Upstream.GetStrategy(),
+			Priority: r.Upstream.Priority,
+		})
+	}
+
+	writeJSON(w, http.StatusOK, routes)
+}
+
+// reloadExternalUpstreams fetches the external upstreams.
+func (a *API) reloadExternalUpstreams(w http.ResponseWriter, _ *http.Request) {
+	config.LoadExternalUpstreams()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// reloadConfig reads the configuration file again.
+func (a *API) reloadConfig(w http.ResponseWriter, _ *http.Request) {
+	if err := config.ReadConfig(a.configFile); err != nil {
+		metrics.ConfigReloads.WithLabelValues(metrics.ResultError).Inc()
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	metrics.ConfigReloads.WithLabelValues(metrics.ResultSuccess).Inc()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// keyMatcher returns a function matching the keys with the suffix or regex query parameters.
+// Without parameters, all the keys match.
+func keyMatcher(r *http.Request) (func(base.Key) bool, error) {
+	suffix, expr := r.URL.Query().Get("suffix"), r.URL.Query().Get("regex")
+
+	switch {
+	case suffix != "" && expr != "":
+		return nil, errors.New("suffix and regex are mutually exclusive")
+	case suffix != "":
+		suffix = strings.ToLower(dns.Fqdn(suffix))
+		return func(k base.Key) bool {
+			return dns.IsSubDomain(suffix, k.Name)
+		}, nil
+	case expr != "":
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex: %w", err)
+		}
+		return func(k base.Key) bool {
+			return re.MatchString(k.Name)
+		}, nil
+	default:
+		return func(base.Key) bool { return true }, nil
+	}
+}
+
+// pathKey returns the cache key of the name and type path values, in the IN class.
+func pathKey(r *http.Request) (base.Key, error) {
+	return base.ParseKey(fmt.Sprintf("%s/%s/%s", r.PathValue("name"), r.PathValue("type"), dns.ClassToString[dns.ClassINET]))
+}
+
+// newCacheEntry converts a cache value to its API representation.
+func newCacheEntry(key base.Key, value base.CacheValue) cacheEntry {
+	e := cacheEntry{
+		Key:      key.String(),
+		Name:     key.Name,
+		Type:     dns.Type(key.Qtype).String(),
+		Class:    dns.Class(key.Qclass).String(),
+		Upstream: key.Upstream,
+		Rcode:    dns.RcodeToString[value.Rcode],
+		ExpireAt: value.ExpireAt,
+	}
+
+	for _, rr := range value.Value {
+		e.Answer = append(e.Answer, rr.String())
+	}
+	for _, rr := range value.Ns {
+		e.Ns = append(e.Ns, rr.String())
+	}
+
+	return e
+}
+
+// writeJSON writes the value as JSON with the given status code.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Error().Err(err).Msg("Error writing admin API response")
+	}
+}
+
+// writeError writes the error as JSON with the given status code.
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, apiError{Error: err.Error()})
+}
@@ -1,6 +1,8 @@
 package base
 
 import (
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/miekg/dns"
@@ -8,19 +10,39 @@ import (
 
 type Cache interface {
 	// Load loads the cache
-	Load(data map[string]CacheValue) error
+	Load(data map[Key]CacheValue) error
 
 	// Get returns the value for the given key
-	Get(domain string) ([]dns.RR, error)
+	Get(key Key) ([]dns.RR, error)
+
+	// GetEntry returns the full entry for the given key, including negative answers.
+	// The entry is not counted as used
+	GetEntry(key Key) (CacheValue, error)
+
+	// Lookup returns the full entry for the given key and its expiration time in a single call,
+	// and false if the key does not exist. The entry may have expired.
+	// The entry is counted as used by the eviction policy and the prefetch
+	Lookup(key Key) (CacheValue, bool)
+
+	// Peek returns the full entry for the given key like Lookup, for the reads that are not client queries.
+	// The entry is not counted as used
+	Peek(key Key) (CacheValue, bool)
 
 	// GetAll returns all the values in the cache
-	GetAll() map[string]CacheValue
+	GetAll() map[Key]CacheValue
 
 	// Set sets the value for the given key
-	Set(domain string, value []dns.RR) error
+	Set(key Key, value []dns.RR) error
+
+	// SetNegative caches a negative answer (NXDOMAIN or NODATA) for the given key,
+	// with the CNAME chain of its answer section if any
+	SetNegative(key Key, rcode int, answer, ns []dns.RR) error
 
 	// Delete deletes the value for the given key
-	Delete(key string) error
+	Delete(key Key) error
+
+	// DeleteName deletes the values for every type and class of the given name
+	DeleteName(name string) error
 
 	// Clear clears the cache
 	Clear() error
@@ -32,23 +54,226 @@ type Cache interface {
 	Len() int
 
 	// Keys returns the keys in the cache
-	Keys() []string
+	Keys() []Key
 
 	// Exists returns true if the key exists
-	Exists(domain string) bool
+	Exists(key Key) bool
 
 	// HasExpired returns true if the key has expired
-	HasExpired(domain string) bool
+	HasExpired(key Key) bool
 
 	// GetExpireAt returns the expiration time
-	GetExpireAt(domain string) time.Time
+	GetExpireAt(key Key) time.Time
+
+	// DeleteExpired deletes the entries expired for longer than the stale window and returns their number
+	DeleteExpired() int
+
+	// PrefetchKeys returns the keys of the entries hit at least minHits times since they were set,
+	// whose remaining TTL is below the given fraction of their TTL
+	PrefetchKeys(minHits uint64, fraction float64) []Key
+
+	// Evictions returns the number of entries evicted to respect the size limits
+	Evictions() uint64
 }
 
 type CacheValue struct {
-	Value    []dns.RR
+	Value []dns.RR
+	// Rcode and Ns hold the response code and the authority section of negative answers.
+	Rcode    int
+	Ns       []dns.RR
 	ExpireAt time.Time
 }
 
+// HasExpired returns true if the value has expired.
+func (v CacheValue) HasExpired() bool {
+	return time.Now().After(v.ExpireAt)
+}
+
+// IsStale returns true if the value has expired for less than the window.
+func (v CacheValue) IsStale(window time.Duration) bool {
+	return v.HasExpired() && time.Since(v.ExpireAt) <= window
+}
+
+// IsNegative returns true if the value is a cached NXDOMAIN or NODATA answer.
+func (v CacheValue) IsNegative() bool {
+	return v.Rcode != dns.RcodeSuccess || len(v.Value) == 0
+}
+
+// Options holds the settings shared by the cache implementations.
+type Options struct {
+	// MinTTL is the minimum duration an entry is kept in the cache.
+	MinTTL time.Duration
+	// MaxTTL is the maximum duration an entry is kept in the cache. Zero means no limit.
+	MaxTTL time.Duration
+	// MaxNegativeTTL is the maximum duration a negative answer is kept in the cache.
+	MaxNegativeTTL time.Duration
+	// MaxEntries and MaxBytes bound the size of the cache. Zero means no limit.
+	MaxEntries int
+	MaxBytes   int
+	// Eviction is the policy used to evict entries when the cache is full: lru or lfu.
+	Eviction string
+	// StaleWindow is the duration expired entries are kept to be served stale. Zero deletes them on expiry.
+	StaleWindow time.Duration
+}
+
+// Eviction policies.
+const (
+	// EvictionLRU evicts the least recently used entry.
+	EvictionLRU = "lru"
+	// EvictionLFU evicts the least frequently used entry, among a sample of the entries.
+	EvictionLFU = "lfu"
+)
+
+// entryOverhead is the estimated size of an entry besides its records, in bytes.
+const entryOverhead = 128
+
+// Size returns the estimated memory size of the entry, in bytes.
+// The records are counted with their wire format length.
+func (v CacheValue) Size(key Key) int {
+	size := entryOverhead + len(key.Name)
+	for _, rr := range v.Value {
+		size += dns.Len(rr)
+	}
+	for _, rr := range v.Ns {
+		size += dns.Len(rr)
+	}
+
+	return size
+}
+
+// ClampTTL returns the ttl bounded by the MinTTL and MaxTTL options.
+func (o Options) ClampTTL(ttl time.Duration) time.Duration {
+	if ttl < o.MinTTL {
+		ttl = o.MinTTL
+	}
+
+	if o.MaxTTL > 0 && ttl > o.MaxTTL {
+		ttl = o.MaxTTL
+	}
+
+	return ttl
+}
+
+// ClampNegativeTTL returns the ttl bounded by the MaxNegativeTTL option.
+func (o Options) ClampNegativeTTL(ttl time.Duration) time.Duration {
+	if ttl > o.MaxNegativeTTL {
+		return o.MaxNegativeTTL
+	}
+
+	return ttl
+}
+
+// NegativeTTL returns the TTL of a negative answer from the SOA record of its
+// authority section, which is the lowest of the SOA TTL and its MINIMUM field (RFC 2308).
+func NegativeTTL(ns []dns.RR) (uint32, error) {
+	for _, rr := range ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return min(soa.Hdr.Ttl, soa.Minttl), nil
+		}
+	}
+
+	return 0, ErrNoSOA
+}
+
+// MinTTL returns the lowest TTL of the given records.
+func MinTTL(rrs []dns.RR) uint32 {
+	var ttl uint32
+	for i, rr := range rrs {
+		if i == 0 || rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
+	}
+
+	return ttl
+}
+
+// WithTTL returns a copy of the records with their TTL set to ttl.
+func WithTTL(rrs []dns.RR, ttl uint32) []dns.RR {
+	out := make([]dns.RR, len(rrs))
+	for i, rr := range rrs {
+		out[i] = dns.Copy(rr)
+		out[i].Header().Ttl = ttl
+	}
+
+	return out
+}
+
+// RemainingTTL returns the number of seconds left before expireAt, rounded up.
+func RemainingTTL(expireAt time.Time) uint32 {
+	remaining := time.Until(expireAt)
+	if remaining <= 0 {
+		return 0
+	}
+
+	return uint32((remaining + time.Second - 1) / time.Second)
+}
+
+// Key identifies a cache entry by question name, type and class.
+type Key struct {
+	Name   string
+	Qtype  uint16
+	Qclass uint16
+	// Upstream identifies the upstream of the answers depending on the client, empty for the shared answers.
+	Upstream string
+}
+
+// NewKey returns the cache key for the given question.
+func NewKey(q dns.Question) Key {
+	return Key{
+		Name:   strings.ToLower(dns.Fqdn(q.Name)),
+		Qtype:  q.Qtype,
+		Qclass: q.Qclass,
+	}
+}
+
+// String returns the key in the "name/type/class" form (e.g. "example.com./A/IN"),
+// followed by "/upstream" for the answers of an upstream depending on the client.
+func (k Key) String() string {
+	s := fmt.Sprintf("%s/%s/%s", k.Name, dns.Type(k.Qtype), dns.Class(k.Qclass))
+	if k.Upstream != "" {
+		s += "/" + k.Upstream
+	}
+
+	return s
+}
+
+// ParseKey parses a key in the "name/type/class" or "name/type/class/upstream" form returned by String.
+func ParseKey(s string) (Key, error) {
+	parts := strings.SplitN(s, "/", 4)
+	if len(parts) < 3 {
+		return Key{}, fmt.Errorf("invalid cache key %q", s)
+	}
+
+	qtype, ok := dns.StringToType[strings.ToUpper(parts[1])]
+	if !ok {
+		return Key{}, fmt.Errorf("invalid type %q in cache key %q", parts[1], s)
+	}
+
+	qclass, ok := dns.StringToClass[strings.ToUpper(parts[2])]
+	if !ok {
+		return Key{}, fmt.Errorf("invalid class %q in cache key %q", parts[2], s)
+	}
+
+	key := NewKey(dns.Question{Name: parts[0], Qtype: qtype, Qclass: qclass})
+	if len(parts) == 4 {
+		key.Upstream = parts[3]
+	}
+
+	return key, nil
+}
+
+// DeleteQuestion deletes the entries of the question of the key for all the upstreams and returns their number.
+func DeleteQuestion(c Cache, key Key) int {
+	count := 0
+	for _, k := range c.Keys() {
+		if k.Name == key.Name && k.Qtype == key.Qtype && k.Qclass == key.Qclass && c.Delete(k) == nil {
+			count++
+		}
+	}
+
+	return count
+}
+
 // GetExpireAt returns the expiration time.
 func GetExpireAt(ttl int) time.Time {
 	return time.Now().Add(time.Duration(ttl) * time.Second)
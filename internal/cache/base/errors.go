@@ -4,3 +4,9 @@ import "errors"
 
 // ErrNotFound is returned when the key is not found.
 var ErrNotFound = errors.New("not found")
+
+// ErrNoSOA is returned when a negative answer has no SOA record in its authority section.
+var ErrNoSOA = errors.New("no SOA record in authority section")
+
+// ErrTooLarge is returned when an entry is larger than the maximum size of the cache.
+var ErrTooLarge = errors.New("entry larger than the cache")
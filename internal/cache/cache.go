@@ -1,6 +1,7 @@
 package cache
 
 import (
+	"bytes"
 	"encoding/gob"
 	"fmt"
 	"os"
@@ -12,11 +13,24 @@ import (
 	"github.com/azrod/dnsr/internal/cache/base"
 	"github.com/azrod/dnsr/internal/cache/memory"
 	"github.com/azrod/dnsr/internal/config"
+	"github.com/azrod/dnsr/internal/metrics"
 )
 
+// sweepInterval is the interval between two deletions of the expired entries.
+const sweepInterval = time.Minute
+
 // New creates a new cache.
 func New() (base.Cache, error) {
-	c, err := memory.New()
+	cfg := config.Get().Cache
+	c, err := memory.NewSharded(base.Options{
+		MinTTL:         cfg.GetMinTTL(),
+		MaxTTL:         cfg.GetMaxTTL(),
+		MaxNegativeTTL: cfg.GetNegativeTTL(),
+		MaxEntries:     cfg.MaxEntries,
+		MaxBytes:       cfg.MaxBytes,
+		Eviction:       cfg.GetEviction(),
+		StaleWindow:    cfg.ServeStale.GetWindow(),
+	}, cfg.GetShards())
 	if err != nil {
 		return nil, err
 	}
@@ -37,8 +51,14 @@ func New() (base.Cache, error) {
 		// new ticker
 		ticker := time.NewTicker(5 * time.Minute)
 		tickerPrint := time.NewTicker(2 * time.Minute)
+		tickerSweep := time.NewTicker(sweepInterval)
 		for {
 			select {
+			case <-tickerSweep.C:
+				if count := c.DeleteExpired(); count > 0 {
+					log.Debug().Msgf("Deleted %d expired cache entries", count)
+					metrics.CacheExpired.Add(float64(count))
+				}
 			case <-ticker.C:
 				if err := PersistCache(c); err != nil {
 					log.Error().Err(err).Msg("Error persisting cache")
@@ -135,6 +155,16 @@ func registerGobTypes() {
 	gob.Register(&dns.SVCBDoHPath{})
 }
 
+// cacheFileVersion is the version of the format written by PersistCache.
+// Files without a version are the legacy format keyed by domain only.
+const cacheFileVersion = 1
+
+// cacheFile is the on-disk representation of the cache.
+type cacheFile struct {
+	Version int
+	Entries map[base.Key]base.CacheValue
+}
+
 // PersistCache will persist the cache to disk.
 func PersistCache(c base.Cache) error {
 	// Read the cache from memory
@@ -157,7 +187,7 @@ func PersistCache(c base.Cache) error {
 	encoder := gob.NewEncoder(file)
 	registerGobTypes()
 
-	if err := encoder.Encode(values); err != nil {
+	if err := encoder.Encode(cacheFile{Version: cacheFileVersion, Entries: values}); err != nil {
 		return fmt.Errorf("error encoding cache: %w", err)
 	}
 
@@ -165,9 +195,9 @@ func PersistCache(c base.Cache) error {
 }
 
 // LoadCache will load the cache from disk.
-func LoadCache() (map[string]base.CacheValue, error) {
+func LoadCache() (map[base.Key]base.CacheValue, error) {
 	// Read the cache from disk
-	file, err := os.Open(getPathCache())
+	data, err := os.ReadFile(getPathCache())
 	if err != nil {
 		switch {
 		case os.IsNotExist(err):
@@ -177,22 +207,49 @@ func LoadCache() (map[string]base.CacheValue, error) {
 			return nil, fmt.Errorf("error opening cache file: %w", err)
 		}
 	}
-	defer file.Close()
 
-	decoder := gob.NewDecoder(file)
 	registerGobTypes()
 
-	var values map[string]base.CacheValue
-	return values, decoder.Decode(&values)
+	var cf cacheFile
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&cf); err == nil {
+		return cf.Entries, nil
+	}
+
+	// Fallback to the legacy format keyed by domain only
+	var legacy map[string]base.CacheValue
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&legacy); err != nil {
+		return nil, fmt.Errorf("error decoding cache file: %w", err)
+	}
+
+	log.Info().Msgf("Migrating legacy cache file (%d entries)", len(legacy))
+	return migrateLegacyCache(legacy), nil
+}
+
+// migrateLegacyCache converts a cache keyed by domain only to the composite key.
+// The type and class are taken from the last record of the answer, which is the
+// record that was asked for once any CNAME chain has been followed.
+func migrateLegacyCache(legacy map[string]base.CacheValue) map[base.Key]base.CacheValue {
+	values := make(map[base.Key]base.CacheValue, len(legacy))
+	for domain, value := range legacy {
+		if len(value.Value) == 0 {
+			continue
+		}
+
+		hdr := value.Value[len(value.Value)-1].Header()
+		values[base.NewKey(dns.Question{Name: domain, Qtype: hdr.Rrtype, Qclass: hdr.Class})] = value
+	}
+
+	return values
 }
 
 // defaultCachePath is the default path to store the cache.
 const defaultCachePath = "./cache.gob"
 
 func getPathCache() string {
-	if config.Cfg.Cache.Path == "" {
+	path := config.Get().Cache.Path
+	if path == "" {
 		return defaultCachePath
 	}
 
-	return config.Cfg.Cache.Path
+	return path
 }
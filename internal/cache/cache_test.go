@@ -0,0 +1,132 @@
+package cache
+
+import (
+	"encoding/gob"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/azrod/dnsr/internal/cache/base"
+	"github.com/azrod/dnsr/internal/cache/memory"
+	"github.com/azrod/dnsr/internal/config"
+)
+
+// setTestCachePath reads a configuration storing the cache in a temporary file and returns its path.
+func setTestCachePath(t *testing.T) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "cache.gob")
+	file := filepath.Join(dir, "config.yaml")
+	content := fmt.Sprintf("server:\n  defaultUpstream: [127.0.0.1:53]\ncache:\n  path: %s\n", path)
+	if err := os.WriteFile(file, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := config.ReadConfig(file); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+// testRR parses the record.
+func testRR(t *testing.T, s string) dns.RR {
+	t.Helper()
+
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return rr
+}
+
+func TestLoadCacheLegacy(t *testing.T) {
+	path := setTestCachePath(t)
+	expireAt := time.Now().Add(time.Hour).Truncate(time.Second)
+
+	legacy := map[string]base.CacheValue{
+		"www.example.com.": {Value: []dns.RR{
+			testRR(t, "www.example.com. 300 IN CNAME example.com."),
+			testRR(t, "example.com. 300 IN A 192.0.2.1"),
+		}, ExpireAt: expireAt},
+		"Example.NET.":       {Value: []dns.RR{testRR(t, "example.net. 300 IN AAAA 2001:db8::1")}, ExpireAt: expireAt},
+		"empty.example.com.": {ExpireAt: expireAt},
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registerGobTypes()
+	if err := gob.NewEncoder(f).Encode(legacy); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	values, err := LoadCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[base.Key]int{
+		{Name: "www.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}: 2,
+		{Name: "example.net.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET}:  1,
+	}
+	if len(values) != len(want) {
+		t.Fatalf("got entries %v, want %v", values, want)
+	}
+	for key, records := range want {
+		value, ok := values[key]
+		if !ok {
+			t.Errorf("got no entry %s", key)
+			continue
+		}
+		if len(value.Value) != records {
+			t.Errorf("got %d records for %s, want %d", len(value.Value), key, records)
+		}
+		if !value.ExpireAt.Equal(expireAt) {
+			t.Errorf("got expiration %s for %s, want %s", value.ExpireAt, key, expireAt)
+		}
+	}
+
+	// The migrated entries are written back in the versioned format
+	c, err := memory.New(base.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Load(values); err != nil {
+		t.Fatal(err)
+	}
+	if err := PersistCache(c); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err = os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var cf cacheFile
+	if err := gob.NewDecoder(f).Decode(&cf); err != nil {
+		t.Fatal(err)
+	}
+	if cf.Version != cacheFileVersion || len(cf.Entries) != len(want) {
+		t.Errorf("got version %d with %d entries, want version %d with %d", cf.Version, len(cf.Entries), cacheFileVersion, len(want))
+	}
+
+	reloaded, err := LoadCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key := range want {
+		if _, ok := reloaded[key]; !ok {
+			t.Errorf("got no entry %s after the round trip", key)
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package memory
 
 import (
+	"container/list"
+	"strings"
 	"sync"
 	"time"
 
@@ -9,108 +11,390 @@ import (
 	"github.com/azrod/dnsr/internal/cache/base"
 )
 
+// lfuSamples is the number of entries compared to select the least frequently used one.
+const lfuSamples = 5
+
 // MemoryCache is an in-memory cache.
+// When the cache is bounded, entries are evicted with the LRU or LFU policy.
 type MemoryCache struct { //nolint:revive
-	mu    sync.RWMutex
-	cache map[string]base.CacheValue
+	mu    sync.Mutex
+	opts  base.Options
+	cache map[base.Key]*entry
+	// lru orders the entries from the most to the least recently used.
+	lru *list.List
+	// hot holds the entries hit since they were set, the only candidates to prefetch.
+	hot       map[base.Key]*entry
+	bytes     int
+	evictions uint64
+}
+
+// entry is a cache value with its usage.
+type entry struct {
+	key   base.Key
+	value base.CacheValue
+	size  int
+	hits  uint64
+	// recentHits is the number of hits since the value was set, and storedAt the time it was set.
+	recentHits uint64
+	storedAt   time.Time
+	elem       *list.Element
 }
 
 var _ base.Cache = &MemoryCache{}
 
 // New creates a new in-memory cache.
-func New() (*MemoryCache, error) {
+func New(opts base.Options) (*MemoryCache, error) {
 	return &MemoryCache{
-		cache: make(map[string]base.CacheValue),
+		opts:  opts,
+		cache: make(map[base.Key]*entry),
+		lru:   list.New(),
+		hot:   make(map[base.Key]*entry),
 	}, nil
 }
 
 // Load loads the cache.
-func (c *MemoryCache) Load(data map[string]base.CacheValue) error {
+func (c *MemoryCache) Load(data map[base.Key]base.CacheValue) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	c.cache = data
+	c.clear()
+	for k, v := range data {
+		// The entries larger than the cache are skipped
+		_ = c.set(k, v)
+	}
 
 	return nil
 }
 
 // Get returns the value for the given key.
-func (c *MemoryCache) Get(domain string) ([]dns.RR, error) {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
+// The TTL of the returned records is the time left before the entry expires.
+func (c *MemoryCache) Get(key base.Key) ([]dns.RR, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-	if !c.exists(domain) {
+	e, ok := c.cache[key]
+	if !ok {
 		return nil, base.ErrNotFound
 	}
+	c.touch(e)
+
+	return base.WithTTL(e.value.Value, base.RemainingTTL(e.value.ExpireAt)), nil
+}
+
+// GetEntry returns the full entry for the given key, including negative answers, without recording a use.
+// The TTL of the returned records is the time left before the entry expires.
+func (c *MemoryCache) GetEntry(key base.Key) (base.CacheValue, error) {
+	v, ok := c.Peek(key)
+	if !ok {
+		return base.CacheValue{}, base.ErrNotFound
+	}
+
+	return v, nil
+}
+
+// Lookup returns the full entry for the given key, and false if the key does not exist.
+// The TTL of the returned records is the time left before the entry expires, zero if it has expired.
+func (c *MemoryCache) Lookup(key base.Key) (base.CacheValue, bool) {
+	return c.lookup(key, true)
+}
+
+// Peek returns the full entry for the given key like Lookup, without recording a use of the entry.
+func (c *MemoryCache) Peek(key base.Key) (base.CacheValue, bool) {
+	return c.lookup(key, false)
+}
+
+// lookup returns the full entry for the given key and records a use of the entry if touch is true.
+func (c *MemoryCache) lookup(key base.Key, touch bool) (base.CacheValue, bool) {
+	c.mu.Lock()
+	e, ok := c.cache[key]
+	if !ok {
+		c.mu.Unlock()
+		return base.CacheValue{}, false
+	}
+	if touch {
+		c.touch(e)
+	}
+	v := e.value
+	c.mu.Unlock()
+
+	// The records are never modified in place, they are copied outside the lock
+	ttl := base.RemainingTTL(v.ExpireAt)
+
+	return base.CacheValue{
+		Value:    base.WithTTL(v.Value, ttl),
+		Rcode:    v.Rcode,
+		Ns:       base.WithTTL(v.Ns, ttl),
+		ExpireAt: v.ExpireAt,
+	}, true
+}
 
-	return c.cache[domain].Value, nil
+// touch records a use of the entry.
+func (c *MemoryCache) touch(e *entry) {
+	e.hits++
+	if e.recentHits++; e.recentHits == 1 {
+		c.hot[e.key] = e
+	}
+	c.lru.MoveToFront(e.elem)
 }
 
 // GetAll returns all the values in the cache.
-func (c *MemoryCache) GetAll() map[string]base.CacheValue {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
+func (c *MemoryCache) GetAll() map[base.Key]base.CacheValue {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-	return c.cache
+	values := make(map[base.Key]base.CacheValue, len(c.cache))
+	for k, e := range c.cache {
+		values[k] = e.value
+	}
+
+	return values
 }
 
 // Exists returns true if the key exists.
-func (c *MemoryCache) Exists(domain string) bool {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
+func (c *MemoryCache) Exists(key base.Key) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-	return c.exists(domain)
+	return c.exists(key)
 }
 
-// exists returns true if the domain exists.
-func (c *MemoryCache) exists(domain string) bool {
-	_, ok := c.cache[domain]
+// exists returns true if the key exists.
+func (c *MemoryCache) exists(key base.Key) bool {
+	_, ok := c.cache[key]
 	return ok
 }
 
 // Set sets the value for the given key.
-func (c *MemoryCache) Set(domain string, value []dns.RR) error {
+func (c *MemoryCache) Set(key base.Key, value []dns.RR) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	ttl := value[0].Header().Ttl
-	// if ttl is below 3600, set it to 3600
-	if ttl < 3600 {
-		ttl = 3600
+	// The RRset expires with its shortest lived record
+	ttl := c.opts.ClampTTL(time.Duration(base.MinTTL(value)) * time.Second)
+
+	return c.set(key, base.CacheValue{
+		Value:    base.WithTTL(value, uint32(ttl/time.Second)),
+		ExpireAt: time.Now().Add(ttl),
+	})
+}
+
+// SetNegative caches a negative answer for the given key, with the CNAME chain of its answer section.
+// The entry lives for the negative TTL taken from the SOA record of the authority section,
+// or less if a record of the chain expires first.
+func (c *MemoryCache) SetNegative(key base.Key, rcode int, answer, ns []dns.RR) error {
+	negTTL, err := base.NegativeTTL(ns)
+	if err != nil {
+		return err
+	}
+	if len(answer) > 0 {
+		negTTL = min(negTTL, base.MinTTL(answer))
 	}
 
-	c.cache[domain] = base.CacheValue{
-		Value:    value,
-		ExpireAt: time.Now().Add(time.Duration(ttl) * time.Second),
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ttl := c.opts.ClampNegativeTTL(time.Duration(negTTL) * time.Second)
+
+	return c.set(key, base.CacheValue{
+		Value:    base.WithTTL(answer, uint32(ttl/time.Second)),
+		Rcode:    rcode,
+		Ns:       base.WithTTL(ns, uint32(ttl/time.Second)),
+		ExpireAt: time.Now().Add(ttl),
+	})
+}
+
+// set stores the value as the most recently used entry, then evicts entries until the cache fits its limits.
+// A value larger than the cache is not stored, and the previous value of the key is deleted.
+func (c *MemoryCache) set(key base.Key, value base.CacheValue) error {
+	size := value.Size(key)
+	if c.opts.MaxBytes > 0 && size > c.opts.MaxBytes {
+		if e, ok := c.cache[key]; ok {
+			c.delete(e)
+		}
+		return base.ErrTooLarge
+	}
+
+	if e, ok := c.cache[key]; ok {
+		c.bytes -= e.size
+		e.value = value
+		e.size = size
+		e.recentHits = 0
+		e.storedAt = time.Now()
+		delete(c.hot, key)
+		c.bytes += e.size
+		c.lru.MoveToFront(e.elem)
+	} else {
+		e = &entry{key: key, value: value, size: size, storedAt: time.Now()}
+		e.elem = c.lru.PushFront(e)
+		c.cache[key] = e
+		c.bytes += e.size
+	}
+
+	// The entry just set fits the limits, it is never evicted
+	for len(c.cache) > 1 && c.full() {
+		c.delete(c.victim(key))
+		c.evictions++
 	}
 
 	return nil
 }
 
+// full returns true if the cache exceeds one of its limits.
+func (c *MemoryCache) full() bool {
+	return (c.opts.MaxEntries > 0 && len(c.cache) > c.opts.MaxEntries) ||
+		(c.opts.MaxBytes > 0 && c.bytes > c.opts.MaxBytes)
+}
+
+// victim returns the entry to evict, other than the entry of the given key.
+// With the LFU policy, an expired entry of the sample is evicted first.
+func (c *MemoryCache) victim(keep base.Key) *entry {
+	now := time.Now()
+
+	if c.opts.Eviction != base.EvictionLFU {
+		// The least recently used entry is at the back of the list
+		for el := c.lru.Back(); el != nil; el = el.Prev() {
+			if e := el.Value.(*entry); e.key != keep {
+				return e
+			}
+		}
+	}
+
+	// The map iteration order is random, the first entries make the sample
+	var victim *entry
+	sampled := 0
+	for k, e := range c.cache {
+		if k == keep {
+			continue
+		}
+		if now.After(e.value.ExpireAt) {
+			return e
+		}
+		if victim == nil || e.hits < victim.hits {
+			victim = e
+		}
+		if sampled++; sampled == lfuSamples {
+			break
+		}
+	}
+
+	return victim
+}
+
+// delete removes the entry.
+func (c *MemoryCache) delete(e *entry) {
+	c.lru.Remove(e.elem)
+	delete(c.cache, e.key)
+	delete(c.hot, e.key)
+	c.bytes -= e.size
+}
+
 // Delete deletes the value for the given key.
-func (c *MemoryCache) Delete(domain string) error {
+func (c *MemoryCache) Delete(key base.Key) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	if !c.exists(domain) {
+	e, ok := c.cache[key]
+	if !ok {
 		return base.ErrNotFound
 	}
 
-	delete(c.cache, domain)
+	c.delete(e)
+
+	return nil
+}
+
+// DeleteName deletes the values for every type and class of the given name.
+func (c *MemoryCache) DeleteName(name string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	name = strings.ToLower(dns.Fqdn(name))
+
+	found := false
+	for k, e := range c.cache {
+		if k.Name == name {
+			c.delete(e)
+			found = true
+		}
+	}
+
+	if !found {
+		return base.ErrNotFound
+	}
 
 	return nil
 }
 
+// DeleteExpired deletes the entries expired for longer than the stale window and returns their number.
+func (c *MemoryCache) DeleteExpired() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	count := 0
+	for _, e := range c.cache {
+		if now.After(e.value.ExpireAt.Add(c.opts.StaleWindow)) {
+			c.delete(e)
+			count++
+		}
+	}
+
+	return count
+}
+
+// PrefetchKeys returns the keys of the entries hit at least minHits times since they were set,
+// whose remaining TTL is below the given fraction of their TTL.
+// Only the entries hit since they were set are searched, the expired ones are no longer candidates.
+func (c *MemoryCache) PrefetchKeys(minHits uint64, fraction float64) []base.Key {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	var keys []base.Key
+	for k, e := range c.hot {
+		if now.After(e.value.ExpireAt) {
+			delete(c.hot, k)
+			continue
+		}
+		if e.recentHits < minHits {
+			continue
+		}
+
+		ttl := e.value.ExpireAt.Sub(e.storedAt)
+		if e.value.ExpireAt.Sub(now) <= time.Duration(fraction*float64(ttl)) {
+			keys = append(keys, k)
+		}
+	}
+
+	return keys
+}
+
+// Evictions returns the number of entries evicted to respect the size limits.
+func (c *MemoryCache) Evictions() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.evictions
+}
+
 // Clear clears the cache.
 func (c *MemoryCache) Clear() error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	c.cache = make(map[string]base.CacheValue)
+	c.clear()
 
 	return nil
 }
 
+// clear removes all the entries.
+func (c *MemoryCache) clear() {
+	c.cache = make(map[base.Key]*entry)
+	c.hot = make(map[base.Key]*entry)
+	c.lru.Init()
+	c.bytes = 0
+}
+
 // Close closes the cache.
 func (c *MemoryCache) Close() error {
 	return nil
@@ -118,18 +402,18 @@ func (c *MemoryCache) Close() error {
 
 // Len returns the number of items in the cache.
 func (c *MemoryCache) Len() int {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
 	return len(c.cache)
 }
 
 // Keys returns the keys in the cache.
-func (c *MemoryCache) Keys() []string {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
+func (c *MemoryCache) Keys() []base.Key {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-	keys := make([]string, 0, len(c.cache))
+	keys := make([]base.Key, 0, len(c.cache))
 	for k := range c.cache {
 		keys = append(keys, k)
 	}
@@ -138,25 +422,27 @@ func (c *MemoryCache) Keys() []string {
 }
 
 // HasExpired returns true if the key has expired.
-func (c *MemoryCache) HasExpired(domain string) bool {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
+func (c *MemoryCache) HasExpired(key base.Key) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-	if !c.exists(domain) {
+	e, ok := c.cache[key]
+	if !ok {
 		return true
 	}
 
-	return time.Now().After(c.cache[domain].ExpireAt)
+	return time.Now().After(e.value.ExpireAt)
 }
 
 // GetExpireAt returns the expiration time.
-func (c *MemoryCache) GetExpireAt(domain string) time.Time {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
+func (c *MemoryCache) GetExpireAt(key base.Key) time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-	if !c.exists(domain) {
+	e, ok := c.cache[key]
+	if !ok {
 		return time.Time{}
 	}
 
-	return c.cache[domain].ExpireAt
+	return e.value.ExpireAt
 }
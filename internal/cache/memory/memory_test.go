@@ -0,0 +1,292 @@
+package memory
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/azrod/dnsr/internal/cache/base"
+)
+
+// benchmarkKeys is the number of names queried by the benchmarks.
+const benchmarkKeys = 4096
+
+func benchmarkOptions() base.Options {
+	return base.Options{
+		MaxTTL:         time.Hour,
+		MaxNegativeTTL: time.Hour,
+		Eviction:       base.EvictionLRU,
+	}
+}
+
+// benchmarkCache measures the concurrent lookups and sets of the cache.
+// Run with -cpu 1,4,16 to compare the scaling of the implementations.
+func benchmarkCache(b *testing.B, c base.Cache) {
+	b.Helper()
+
+	keys := make([]base.Key, benchmarkKeys)
+	values := make([][]dns.RR, benchmarkKeys)
+	for i := range keys {
+		name := fmt.Sprintf("host%d.example.com.", i)
+		keys[i] = base.NewKey(dns.Question{Name: name, Qtype: dns.TypeA, Qclass: dns.ClassINET})
+		values[i] = []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+			A:   net.IPv4(10, 0, byte(i>>8), byte(i)),
+		}}
+		if err := c.Set(keys[i], values[i]); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.Run("Lookup", func(b *testing.B) {
+		b.RunParallel(func(pb *testing.PB) {
+			i := rand.Intn(benchmarkKeys) //nolint:gosec
+			for pb.Next() {
+				if _, ok := c.Lookup(keys[i%benchmarkKeys]); !ok {
+					b.Error("missing entry")
+				}
+				i++
+			}
+		})
+	})
+
+	b.Run("Set", func(b *testing.B) {
+		b.RunParallel(func(pb *testing.PB) {
+			i := rand.Intn(benchmarkKeys) //nolint:gosec
+			for pb.Next() {
+				if err := c.Set(keys[i%benchmarkKeys], values[i%benchmarkKeys]); err != nil {
+					b.Error(err)
+				}
+				i++
+			}
+		})
+	})
+
+	b.Run("LookupSet", func(b *testing.B) {
+		b.RunParallel(func(pb *testing.PB) {
+			i := rand.Intn(benchmarkKeys) //nolint:gosec
+			for pb.Next() {
+				// One set for every nine lookups, like a cache with a high hit ratio
+				if i%10 == 0 {
+					_ = c.Set(keys[i%benchmarkKeys], values[i%benchmarkKeys])
+				} else {
+					c.Lookup(keys[i%benchmarkKeys])
+				}
+				i++
+			}
+		})
+	})
+}
+
+func BenchmarkMemoryCache(b *testing.B) {
+	c, err := New(benchmarkOptions())
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	benchmarkCache(b, c)
+}
+
+func BenchmarkShardedCache(b *testing.B) {
+	c, err := NewSharded(benchmarkOptions(), 16)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	benchmarkCache(b, c)
+}
+
+func TestShardedCacheMaxEntries(t *testing.T) {
+	opts := benchmarkOptions()
+	opts.MaxEntries = 100
+
+	c, err := NewSharded(opts, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 1000; i++ {
+		name := fmt.Sprintf("host%d.example.com.", i)
+		key := base.NewKey(dns.Question{Name: name, Qtype: dns.TypeA, Qclass: dns.ClassINET})
+		if err := c.Set(key, []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+			A:   net.IPv4(10, 0, 0, 1),
+		}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := c.Len(); n > opts.MaxEntries {
+		t.Errorf("got %d entries, want at most %d", n, opts.MaxEntries)
+	}
+}
+
+// setTestEntry caches an A record for the name and returns its key.
+func setTestEntry(t *testing.T, c base.Cache, name string) base.Key {
+	t.Helper()
+
+	key := base.NewKey(dns.Question{Name: name, Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	if err := c.Set(key, []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+		A:   net.IPv4(10, 0, 0, 1),
+	}}); err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+func TestMemoryCachePeek(t *testing.T) {
+	tests := []struct {
+		name string
+		read func(c *MemoryCache, key base.Key) bool
+		// wantKept is true if the entry read is kept when the cache is full.
+		wantKept bool
+	}{
+		{
+			name: "lookup",
+			read: func(c *MemoryCache, key base.Key) bool {
+				_, ok := c.Lookup(key)
+				return ok
+			},
+			wantKept: true,
+		},
+		{
+			name: "peek",
+			read: func(c *MemoryCache, key base.Key) bool {
+				_, ok := c.Peek(key)
+				return ok
+			},
+		},
+		{
+			name: "get entry",
+			read: func(c *MemoryCache, key base.Key) bool {
+				_, err := c.GetEntry(key)
+				return err == nil
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := benchmarkOptions()
+			opts.MaxEntries = 2
+
+			c, err := New(opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			first := setTestEntry(t, c, "first.example.com.")
+			setTestEntry(t, c, "second.example.com.")
+
+			if !tt.read(c, first) {
+				t.Fatal("entry not found")
+			}
+			if keys := c.PrefetchKeys(1, 1); (len(keys) == 1) != tt.wantKept {
+				t.Errorf("got prefetch keys %v, want the entry read: %t", keys, tt.wantKept)
+			}
+
+			setTestEntry(t, c, "third.example.com.")
+			if kept := c.Exists(first); kept != tt.wantKept {
+				t.Errorf("got entry kept %t, want %t", kept, tt.wantKept)
+			}
+		})
+	}
+}
+
+func TestShardedCacheMaxBytes(t *testing.T) {
+	for _, maxBytes := range []int{1 << 10, 1 << 20} {
+		t.Run(fmt.Sprint(maxBytes), func(t *testing.T) {
+			opts := benchmarkOptions()
+			opts.MaxBytes = maxBytes
+
+			c, err := NewSharded(opts, 16)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i := 0; i < 20000; i++ {
+				setTestEntry(t, c, fmt.Sprintf("host%d.example.com.", i))
+			}
+
+			size := 0
+			for k, v := range c.GetAll() {
+				size += v.Size(k)
+			}
+			if size > maxBytes {
+				t.Errorf("got %d bytes, want at most %d", size, maxBytes)
+			}
+			if c.Len() == 0 {
+				t.Error("got no entries")
+			}
+		})
+	}
+}
+
+func TestMemoryCacheTooLarge(t *testing.T) {
+	opts := benchmarkOptions()
+	opts.MaxBytes = 256
+
+	c, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := setTestEntry(t, c, "small.example.com.")
+
+	var txt []dns.RR
+	for i := 0; i < 10; i++ {
+		txt = append(txt, &dns.TXT{
+			Hdr: dns.RR_Header{Name: key.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 300},
+			Txt: []string{fmt.Sprintf("record %d", i)},
+		})
+	}
+
+	if err := c.Set(key, txt); !errors.Is(err, base.ErrTooLarge) {
+		t.Errorf("got error %v, want %v", err, base.ErrTooLarge)
+	}
+	if c.Exists(key) {
+		t.Error("got the previous value of the key kept")
+	}
+}
+
+func TestMemoryCachePrefetchKeys(t *testing.T) {
+	c, err := New(benchmarkOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := make([]base.Key, 1000)
+	for i := range keys {
+		keys[i] = setTestEntry(t, c, fmt.Sprintf("host%d.example.com.", i))
+	}
+
+	// Only the entries hit since they were set are candidates
+	for _, key := range keys[:3] {
+		c.Lookup(key)
+	}
+	c.Lookup(keys[0])
+	c.Lookup(keys[1])
+
+	if got := c.PrefetchKeys(2, 1); len(got) != 2 {
+		t.Errorf("got prefetch keys %v, want 2", got)
+	}
+	if len(c.hot) != 3 {
+		t.Errorf("got %d candidates, want 3", len(c.hot))
+	}
+
+	// The hits are counted again when the entry is set
+	setTestEntry(t, c, keys[0].Name)
+	if got := c.PrefetchKeys(2, 1); len(got) != 1 || got[0] != keys[1] {
+		t.Errorf("got prefetch keys %v, want [%s]", got, keys[1])
+	}
+	if len(c.hot) != 2 {
+		t.Errorf("got %d candidates, want 2", len(c.hot))
+	}
+}
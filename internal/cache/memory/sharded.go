@@ -0,0 +1,218 @@
+package memory
+
+import (
+	"hash/maphash"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/azrod/dnsr/internal/cache/base"
+)
+
+// ShardedCache is an in-memory cache split in shards, each with its own lock,
+// so that concurrent queries of different names do not wait for each other.
+// All the types of a name are in the same shard.
+type ShardedCache struct {
+	seed   maphash.Seed
+	shards []*MemoryCache
+}
+
+var _ base.Cache = &ShardedCache{}
+
+// minShardBytes is the minimum size limit of a shard, so that the shards of a small cache hold more than a few entries.
+const minShardBytes = 64 << 10
+
+// NewSharded creates a new in-memory cache with the given number of shards.
+// The size limits of the options are shared equally between the shards, rounded down
+// so that the cache never exceeds them. There are never more shards than the maximum number of entries,
+// and fewer shards when the maximum size would leave less than 64 KiB to each of them.
+func NewSharded(opts base.Options, shards int) (*ShardedCache, error) {
+	shards = max(shards, 1)
+	if opts.MaxEntries > 0 {
+		shards = min(shards, opts.MaxEntries)
+	}
+	if opts.MaxBytes > 0 {
+		shards = max(1, min(shards, opts.MaxBytes/minShardBytes))
+	}
+
+	shardOpts := opts
+	if opts.MaxEntries > 0 {
+		shardOpts.MaxEntries = opts.MaxEntries / shards
+	}
+	if opts.MaxBytes > 0 {
+		shardOpts.MaxBytes = opts.MaxBytes / shards
+	}
+
+	c := &ShardedCache{
+		seed:   maphash.MakeSeed(),
+		shards: make([]*MemoryCache, shards),
+	}
+	for i := range c.shards {
+		shard, err := New(shardOpts)
+		if err != nil {
+			return nil, err
+		}
+		c.shards[i] = shard
+	}
+
+	return c, nil
+}
+
+// shard returns the shard of the name.
+func (c *ShardedCache) shard(name string) *MemoryCache {
+	return c.shards[maphash.String(c.seed, name)%uint64(len(c.shards))]
+}
+
+// Load loads the cache.
+func (c *ShardedCache) Load(data map[base.Key]base.CacheValue) error {
+	split := make([]map[base.Key]base.CacheValue, len(c.shards))
+	for i := range split {
+		split[i] = make(map[base.Key]base.CacheValue)
+	}
+	for k, v := range data {
+		split[maphash.String(c.seed, k.Name)%uint64(len(c.shards))][k] = v
+	}
+
+	for i, shard := range c.shards {
+		if err := shard.Load(split[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Get returns the value for the given key.
+func (c *ShardedCache) Get(key base.Key) ([]dns.RR, error) {
+	return c.shard(key.Name).Get(key)
+}
+
+// GetEntry returns the full entry for the given key, including negative answers, without recording a use.
+func (c *ShardedCache) GetEntry(key base.Key) (base.CacheValue, error) {
+	return c.shard(key.Name).GetEntry(key)
+}
+
+// Lookup returns the full entry for the given key, and false if the key does not exist.
+func (c *ShardedCache) Lookup(key base.Key) (base.CacheValue, bool) {
+	return c.shard(key.Name).Lookup(key)
+}
+
+// Peek returns the full entry for the given key without recording a use of the entry.
+func (c *ShardedCache) Peek(key base.Key) (base.CacheValue, bool) {
+	return c.shard(key.Name).Peek(key)
+}
+
+// GetAll returns all the values in the cache.
+func (c *ShardedCache) GetAll() map[base.Key]base.CacheValue {
+	values := make(map[base.Key]base.CacheValue)
+	for _, shard := range c.shards {
+		for k, v := range shard.GetAll() {
+			values[k] = v
+		}
+	}
+
+	return values
+}
+
+// Set sets the value for the given key.
+func (c *ShardedCache) Set(key base.Key, value []dns.RR) error {
+	return c.shard(key.Name).Set(key, value)
+}
+
+// SetNegative caches a negative answer for the given key.
+func (c *ShardedCache) SetNegative(key base.Key, rcode int, answer, ns []dns.RR) error {
+	return c.shard(key.Name).SetNegative(key, rcode, answer, ns)
+}
+
+// Delete deletes the value for the given key.
+func (c *ShardedCache) Delete(key base.Key) error {
+	return c.shard(key.Name).Delete(key)
+}
+
+// DeleteName deletes the values for every type and class of the given name.
+func (c *ShardedCache) DeleteName(name string) error {
+	name = strings.ToLower(dns.Fqdn(name))
+	return c.shard(name).DeleteName(name)
+}
+
+// DeleteExpired deletes the entries expired for longer than the stale window and returns their number.
+func (c *ShardedCache) DeleteExpired() int {
+	count := 0
+	for _, shard := range c.shards {
+		count += shard.DeleteExpired()
+	}
+
+	return count
+}
+
+// PrefetchKeys returns the keys of the popular entries close to their expiry.
+func (c *ShardedCache) PrefetchKeys(minHits uint64, fraction float64) []base.Key {
+	var keys []base.Key
+	for _, shard := range c.shards {
+		keys = append(keys, shard.PrefetchKeys(minHits, fraction)...)
+	}
+
+	return keys
+}
+
+// Evictions returns the number of entries evicted to respect the size limits.
+func (c *ShardedCache) Evictions() uint64 {
+	var count uint64
+	for _, shard := range c.shards {
+		count += shard.Evictions()
+	}
+
+	return count
+}
+
+// Clear clears the cache.
+func (c *ShardedCache) Clear() error {
+	for _, shard := range c.shards {
+		if err := shard.Clear(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Close closes the cache.
+func (c *ShardedCache) Close() error {
+	return nil
+}
+
+// Len returns the number of items in the cache.
+func (c *ShardedCache) Len() int {
+	count := 0
+	for _, shard := range c.shards {
+		count += shard.Len()
+	}
+
+	return count
+}
+
+// Keys returns the keys in the cache.
+func (c *ShardedCache) Keys() []base.Key {
+	var keys []base.Key
+	for _, shard := range c.shards {
+		keys = append(keys, shard.Keys()...)
+	}
+
+	return keys
+}
+
+// Exists returns true if the key exists.
+func (c *ShardedCache) Exists(key base.Key) bool {
+	return c.shard(key.Name).Exists(key)
+}
+
+// HasExpired returns true if the key has expired.
+func (c *ShardedCache) HasExpired(key base.Key) bool {
+	return c.shard(key.Name).HasExpired(key)
+}
+
+// GetExpireAt returns the expiration time.
+func (c *ShardedCache) GetExpireAt(key base.Key) time.Time {
+	return c.shard(key.Name).GetExpireAt(key)
+}
@@ -0,0 +1,110 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+)
+
+// Responses to the clients denied by the access control lists.
+const (
+	DenyRefused = "refused"
+	DenyDrop    = "drop"
+)
+
+// ACL is an access control list of client subnets.
+// The denied subnets win over the allowed ones, all the clients are allowed without allowed subnets.
+type ACL struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// newACL parses the allowed and denied subnets.
+func newACL(allow, deny []string) (*ACL, error) {
+	a, err := parseSubnets(allow)
+	if err != nil {
+		return nil, err
+	}
+
+	d, err := parseSubnets(deny)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ACL{allow: a, deny: d}, nil
+}
+
+// IsAllowed returns true if the client is allowed by the list.
+// A client without address is only allowed by a list without subnets.
+func (a *ACL) IsAllowed(ip net.IP) bool {
+	if a == nil || (len(a.allow) == 0 && len(a.deny) == 0) {
+		return true
+	}
+
+	if ip == nil || slices.ContainsFunc(a.deny, func(n *net.IPNet) bool { return n.Contains(ip) }) {
+		return false
+	}
+
+	return len(a.allow) == 0 || slices.ContainsFunc(a.allow, func(n *net.IPNet) bool { return n.Contains(ip) })
+}
+
+// parseSubnets parses a list of subnets, a single address is a /32 or /128 subnet.
+func parseSubnets(subnets []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(subnets))
+	for _, s := range subnets {
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+
+		_, network, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid subnet: %w", err)
+		}
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+// compileACLs parses the access control lists of the server.
+func (s *Server) compileACLs() (err error) {
+	switch s.DenyAction {
+	case "", DenyRefused, DenyDrop:
+	default:
+		return fmt.Errorf("unknown deny action %q", s.DenyAction)
+	}
+
+	if s.acl, err = newACL(s.Allow, s.Deny); err != nil {
+		return fmt.Errorf("server acl: %w", err)
+	}
+
+	if s.commandsACL, err = newACL(s.CommandsAllow, s.CommandsDeny); err != nil {
+		return fmt.Errorf("server commands acl: %w", err)
+	}
+
+	return nil
+}
+
+// IsAllowed returns true if the client is allowed to query the server.
+func (s *Server) IsAllowed(ip net.IP) bool {
+	return s.acl.IsAllowed(ip)
+}
+
+// IsCommandAllowed returns true if the client is allowed to send the clear/ DNS commands.
+func (s *Server) IsCommandAllowed(ip net.IP) bool {
+	return s.commandsACL.IsAllowed(ip)
+}
+
+// GetDenyAction returns the response to the denied clients.
+func (s *Server) GetDenyAction() string {
+	if s.DenyAction == "" {
+		return DenyRefused
+	}
+
+	return s.DenyAction
+}
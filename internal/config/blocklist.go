@@ -0,0 +1,324 @@
+package config
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rs/zerolog/log"
+
+	"github.com/azrod/dnsr/internal/metrics"
+)
+
+// Responses to the blocked queries.
+const (
+	// BlockNXDomain answers NXDOMAIN.
+	BlockNXDomain = "nxdomain"
+	// BlockNull answers 0.0.0.0 to A queries and :: to AAAA queries.
+	BlockNull = "null"
+	// BlockRefused answers REFUSED.
+	BlockRefused = "refused"
+	// BlockCustom answers the configured addresses.
+	BlockCustom = "custom"
+)
+
+const (
+	// defaultBlocklistsInterval is the default interval between two fetches of the lists.
+	defaultBlocklistsInterval = 24 * time.Hour
+	// defaultBlockTTL is the default TTL of the blocked answers.
+	defaultBlockTTL = 60
+)
+
+var Bl = &BlocklistsDB{sets: make(map[string]*domainSet)}
+
+type (
+	// Blocklists configures the blocking of domains.
+	Blocklists struct {
+		Enabled bool `yaml:"enabled"`
+		// Lists are the URLs of the blocklists, in hosts, AdBlock (||domain^) or plain domain format.
+		Lists []ExternalUpstreamConfig `yaml:"lists"`
+		// Allowlists are the URLs of the allowlists, in the same formats. They override the blocklists.
+		Allowlists []ExternalUpstreamConfig `yaml:"allowlists"`
+		// Block and Allow are domains blocked and allowed with their subdomains.
+		Block []string `yaml:"block"`
+		Allow []string `yaml:"allow"`
+		// Response is the answer to the blocked queries: nxdomain, null, refused or custom. Default is nxdomain.
+		Response string `yaml:"response"`
+		// IPs are the addresses of the custom response.
+		IPs []string `yaml:"ips"`
+		// TTL is the TTL of the blocked answers, in seconds. Default is 60.
+		TTL int `yaml:"ttl"`
+		// Interval is the interval between two fetches of the lists, in minutes. Default is 1440.
+		Interval int `yaml:"interval"`
+	}
+
+	// BlocklistsDB holds the domains of the blocklists and allowlists.
+	BlocklistsDB struct {
+		mu sync.RWMutex
+		// sets holds the domains fetched from each list, by URL.
+		sets    map[string]*domainSet
+		blocked []*domainSet
+		allowed []*domainSet
+	}
+
+	// domainSet is a set of domains, matched exactly or with their subdomains.
+	domainSet struct {
+		names    map[string]struct{}
+		suffixes map[string]struct{}
+	}
+)
+
+func newDomainSet() *domainSet {
+	return &domainSet{
+		names:    make(map[string]struct{}),
+		suffixes: make(map[string]struct{}),
+	}
+}
+
+// contains returns true if the name or one of its parents, for the suffixes, is in the set.
+func (s *domainSet) contains(name string) bool {
+	if _, ok := s.names[name]; ok {
+		return true
+	}
+
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if _, ok := s.suffixes[name[off:]]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// len returns the number of domains of the set.
+func (s *domainSet) len() int {
+	return len(s.names) + len(s.suffixes)
+}
+
+// hostsIgnored are the names of the hosts format lists which are not blocked.
+var hostsIgnored = map[string]struct{}{
+	"localhost.": {}, "localhost.localdomain.": {}, "local.": {}, "broadcasthost.": {},
+	"ip6-localhost.": {}, "ip6-loopback.": {}, "ip6-localnet.": {}, "ip6-mcastprefix.": {},
+	"ip6-allnodes.": {}, "ip6-allrouters.": {}, "ip6-allhosts.": {}, "0.0.0.0.": {},
+}
+
+// parseDomainList parses a list in hosts, AdBlock or plain domain format, the format is detected by line.
+// The AdBlock rules block the domain and its subdomains, the other formats block the domain only.
+// The AdBlock exceptions (@@||domain^) are returned as allowed domains.
+func parseDomainList(content []byte) (blocked, allowed *domainSet) {
+	blocked, allowed = newDomainSet(), newDomainSet()
+
+	add := func(set map[string]struct{}, name string) {
+		if _, ok := dns.IsDomainName(name); ok {
+			set[strings.ToLower(dns.Fqdn(name))] = struct{}{}
+		}
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == '!' || line[0] == '[' {
+			continue
+		}
+
+		// AdBlock rules, the rules with options or patterns are not supported
+		if rule, ok := strings.CutPrefix(line, "@@||"); ok {
+			if name, ok := strings.CutSuffix(rule, "^"); ok && !strings.ContainsAny(name, "*/$") {
+				add(allowed.suffixes, name)
+			}
+			continue
+		}
+		if rule, ok := strings.CutPrefix(line, "||"); ok {
+			if name, ok := strings.CutSuffix(rule, "^"); ok && !strings.ContainsAny(name, "*/$") {
+				add(blocked.suffixes, name)
+			}
+			continue
+		}
+
+		line, _, _ = strings.Cut(line, "#")
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 1:
+			add(blocked.names, fields[0])
+		case len(fields) > 1 && net.ParseIP(fields[0]) != nil:
+			for _, name := range fields[1:] {
+				if _, ok := hostsIgnored[strings.ToLower(dns.Fqdn(name))]; !ok {
+					add(blocked.names, name)
+				}
+			}
+		}
+	}
+
+	return blocked, allowed
+}
+
+// checkBlocklists returns an error if the response of the blocked queries is invalid.
+func checkBlocklists(b Blocklists) error {
+	switch b.Response {
+	case "", BlockNXDomain, BlockNull, BlockRefused:
+		return nil
+	case BlockCustom:
+		if len(b.IPs) == 0 {
+			return fmt.Errorf("blocklists: the custom response requires ips")
+		}
+		for _, ip := range b.IPs {
+			if net.ParseIP(ip) == nil {
+				return fmt.Errorf("blocklists: invalid ip %q", ip)
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("blocklists: unknown response %q", b.Response)
+	}
+}
+
+// GetResponse returns the answer to the blocked queries.
+func (b *Blocklists) GetResponse() string {
+	if b.Response == "" {
+		return BlockNXDomain
+	}
+
+	return b.Response
+}
+
+// GetTTL returns the TTL of the blocked answers.
+func (b *Blocklists) GetTTL() uint32 {
+	if b.TTL <= 0 {
+		return defaultBlockTTL
+	}
+
+	return uint32(b.TTL)
+}
+
+// GetInterval returns the interval between two fetches of the lists.
+func (b *Blocklists) GetInterval() time.Duration {
+	if b.Interval <= 0 {
+		return defaultBlocklistsInterval
+	}
+
+	return time.Duration(b.Interval) * time.Minute
+}
+
+// LoadBlocklists fetches the blocklists and allowlists of the configuration.
+// The lists that can not be fetched keep the domains of the last successful fetch.
+func LoadBlocklists() {
+	b := Get().Blocklists
+
+	if !b.Enabled {
+		Bl.compute(b)
+		return
+	}
+
+	var wg sync.WaitGroup
+	for _, list := range append(b.Lists, b.Allowlists...) {
+		wg.Add(1)
+		go func(list ExternalUpstreamConfig) {
+			defer wg.Done()
+
+			body, err := fetchExternal(list, "text/plain")
+			if err != nil {
+				log.Error().Err(err).Msgf("Error fetching list from %s", list.URL)
+				metrics.BlocklistsFetches.WithLabelValues(list.URL, metrics.ResultError).Inc()
+				return
+			}
+
+			if !hdbe.HasUpdated(list.URL, body) && Bl.has(list.URL) {
+				metrics.BlocklistsFetches.WithLabelValues(list.URL, metrics.ResultUnchanged).Inc()
+				return
+			}
+
+			blocked, allowed := parseDomainList(body)
+			log.Info().Msgf("Found %d domain(s) and %d exception(s) in %s", blocked.len(), allowed.len(), list.URL)
+
+			Bl.set(list.URL, blocked, allowed)
+			hdbe.Update(list.URL, hdbe.ComputeHash(body))
+			metrics.BlocklistsFetches.WithLabelValues(list.URL, metrics.ResultSuccess).Inc()
+		}(list)
+	}
+	wg.Wait()
+
+	Bl.compute(b)
+}
+
+// has returns true if the list has been fetched.
+func (d *BlocklistsDB) has(url string) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	_, ok := d.sets[url]
+	return ok
+}
+
+// set stores the domains fetched from the list.
+// The exceptions of a list are stored as the list of the same URL in an allowlist.
+func (d *BlocklistsDB) set(url string, blocked, allowed *domainSet) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.sets[url] = blocked
+	d.sets["@@"+url] = allowed
+}
+
+// compute selects the fetched lists of the configuration.
+// The domains of an allowlist are allowed whatever their format.
+func (d *BlocklistsDB) compute(b Blocklists) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.blocked, d.allowed = nil, nil
+	if !b.Enabled {
+		return
+	}
+
+	block, allow := newDomainSet(), newDomainSet()
+	for _, name := range b.Block {
+		block.suffixes[strings.ToLower(dns.Fqdn(name))] = struct{}{}
+	}
+	for _, name := range b.Allow {
+		allow.suffixes[strings.ToLower(dns.Fqdn(name))] = struct{}{}
+	}
+	d.blocked = append(d.blocked, block)
+	d.allowed = append(d.allowed, allow)
+
+	for _, list := range b.Lists {
+		if s, ok := d.sets[list.URL]; ok {
+			d.blocked = append(d.blocked, s)
+			d.allowed = append(d.allowed, d.sets["@@"+list.URL])
+		}
+	}
+	for _, list := range b.Allowlists {
+		if s, ok := d.sets[list.URL]; ok {
+			d.allowed = append(d.allowed, s, d.sets["@@"+list.URL])
+		}
+	}
+}
+
+// IsBlocked returns true if the name is in a blocklist and not in an allowlist.
+func (d *BlocklistsDB) IsBlocked(name string) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if len(d.blocked) == 0 {
+		return false
+	}
+
+	name = strings.ToLower(dns.Fqdn(name))
+	for _, s := range d.allowed {
+		if s.contains(name) {
+			return false
+		}
+	}
+
+	for _, s := range d.blocked {
+		if s.contains(name) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,93 @@
+package config
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+// setNames returns the sorted names of the set, nil if it is empty.
+func setNames(set map[string]struct{}) []string {
+	var names []string
+	for name := range set {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	return names
+}
+
+func TestParseDomainList(t *testing.T) {
+	tests := []struct {
+		name         string
+		content      string
+		wantNames    []string
+		wantSuffixes []string
+		wantAllowed  []string
+	}{
+		{
+			name: "hosts",
+			content: `127.0.0.1 localhost
+::1 localhost ip6-localhost ip6-loopback
+0.0.0.0 0.0.0.0
+0.0.0.0 ads.example.com
+0.0.0.0 Tracker.Example.com tracker2.example.com # trackers
+::  ipv6.example.com`,
+			wantNames: []string{"ads.example.com.", "ipv6.example.com.", "tracker.example.com.", "tracker2.example.com."},
+		},
+		{
+			name: "plain domains",
+			content: `ads.example.com
+tracker.example.com.
+  spaced.example.com  `,
+			wantNames: []string{"ads.example.com.", "spaced.example.com.", "tracker.example.com."},
+		},
+		{
+			name: "adblock",
+			content: `[Adblock Plus 2.0]
+||ads.example.com^
+||Tracker.Example.com^
+@@||good.ads.example.com^`,
+			wantSuffixes: []string{"ads.example.com.", "tracker.example.com."},
+			wantAllowed:  []string{"good.ads.example.com."},
+		},
+		{
+			name: "comments",
+			content: `# hosts comment
+! adblock comment
+ads.example.com # trailing comment
+#commented.example.com`,
+			wantNames: []string{"ads.example.com."},
+		},
+		{
+			name: "invalid lines",
+			content: `||options.example.com^$third-party
+||*.wildcard.example.com^
+||path.example.com/ads^
+||unterminated.example.com
+@@||*.allowed.example.com^
+not-an-ip ads.example.com
+bad..example.com
+0.0.0.0 ` + strings.Repeat("a", 64) + `.example.com`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			blocked, allowed := parseDomainList([]byte(tt.content))
+
+			if got := setNames(blocked.names); !slices.Equal(got, tt.wantNames) {
+				t.Errorf("got blocked names %v, want %v", got, tt.wantNames)
+			}
+			if got := setNames(blocked.suffixes); !slices.Equal(got, tt.wantSuffixes) {
+				t.Errorf("got blocked suffixes %v, want %v", got, tt.wantSuffixes)
+			}
+			if len(allowed.names) != 0 {
+				t.Errorf("got allowed names %v, want none", allowed.names)
+			}
+			if got := setNames(allowed.suffixes); !slices.Equal(got, tt.wantAllowed) {
+				t.Errorf("got allowed suffixes %v, want %v", got, tt.wantAllowed)
+			}
+		})
+	}
+}
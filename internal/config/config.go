@@ -6,50 +6,213 @@ package config
 import (
 	"fmt"
 	"net"
+	"net/url"
 	"os"
+	"path"
 	"regexp"
-	"sync"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/fsnotify/fsnotify"
+	"github.com/miekg/dns"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"gopkg.in/yaml.v3"
+
+	"github.com/azrod/dnsr/internal/metrics"
+)
+
+// Schemes supported by the upstream DNS servers.
+const (
+	// SchemeTLS is DNS-over-TLS (RFC 7858).
+	SchemeTLS = "tls"
+	// SchemeHTTPS is DNS-over-HTTPS (RFC 8484).
+	SchemeHTTPS = "https"
+)
+
+// Policies used to evict entries when the cache is full.
+const (
+	EvictionLRU = "lru"
+	EvictionLFU = "lfu"
+)
+
+// Strategies used to select the upstream DNS servers of a request.
+const (
+	// StrategySequential tries the servers one after the other, in the configured order.
+	StrategySequential = "sequential"
+	// StrategyParallel sends the request to all the servers and keeps the first successful answer.
+	StrategyParallel = "parallel"
+	// StrategyRoundRobin starts with the next server at each request.
+	StrategyRoundRobin = "round-robin"
+	// StrategyRandom tries the servers in a random order.
+	StrategyRandom = "random"
+	// StrategyLowestLatency tries the fastest servers first.
+	StrategyLowestLatency = "lowest-latency"
 )
 
 var (
-	Cfg = &Config{}
-	Md  = &MatchDomains{Regex: make(map[*regexp.Regexp][]string)}
+	// current is the configuration in use, replaced as a whole when the file is read.
+	current atomic.Pointer[Config]
+	Md      = &MatchDomains{}
 )
 
+func init() {
+	current.Store(&Config{})
+}
+
+// Get returns the configuration in use.
+// The configuration is never modified once published, a request reads a single
+// snapshot to see a consistent configuration while the file is reloaded.
+func Get() *Config {
+	return current.Load()
+}
+
 type (
-	MatchDomains struct {
-		mu    sync.RWMutex
-		Regex map[*regexp.Regexp][]string
-	}
 	Upstream struct {
 		Name       string           `yaml:"name"`
 		DNSServers []string         `yaml:"servers"`
 		HostRegex  []string         `yaml:"regex"`
 		Regex      []*regexp.Regexp `yaml:"-"`
+		// Domains are the names matched exactly.
+		Domains []string `yaml:"domains"`
+		// Suffixes are the zones matched with all their subdomains, e.g. corp.example.
+		Suffixes []string `yaml:"suffixes"`
+		// Wildcards are the names matched label by label with glob patterns, e.g. *.corp.example.
+		Wildcards []string `yaml:"wildcards"`
+		// Qtypes restricts the upstream to the queries of these types, e.g. PTR.
+		Qtypes []string `yaml:"qtypes"`
+		Types  []uint16 `yaml:"-"`
+		// Clients restricts the upstream to the clients of these subnets, e.g. 10.1.0.0/16.
+		Clients  []string     `yaml:"clients"`
+		Networks []*net.IPNet `yaml:"-"`
+		// Listeners restricts the upstream to the queries received on these listeners: udp, tcp, tls or https.
+		Listeners []string `yaml:"listeners"`
+		// Strategy is the strategy used to select the servers. Default is sequential.
+		Strategy string `yaml:"strategy"`
+		// Timeout is the timeout of each attempt, in milliseconds. Default is the server upstreamTimeout.
+		Timeout int `yaml:"timeout"`
+		// Priority orders the routing rules, the upstreams with the highest priority are matched first.
+		// Upstreams with the same priority are matched in the order they are declared.
+		Priority int `yaml:"priority"`
 	}
 
 	Server struct {
 		Host            string   `yaml:"host"`
 		Port            int      `yaml:"port"`
 		DefaultUpstream []string `yaml:"defaultUpstream"`
-		LogLevel        string   `yaml:"logLevel"`
+		// DefaultUpstreamStrategy is the strategy used to select the default upstream servers.
+		DefaultUpstreamStrategy string `yaml:"defaultUpstreamStrategy"`
+		// UpstreamTimeout is the timeout of each attempt to an upstream server, in milliseconds.
+		UpstreamTimeout int `yaml:"upstreamTimeout"`
+		// RoutingMode is the way the upstream of a domain is selected
+		// when several upstreams match it. Default is ordered.
+		RoutingMode string `yaml:"routingMode"`
+		// DisableDNSCommands disables the clear/ cache commands sent as DNS queries.
+		DisableDNSCommands bool `yaml:"disableDNSCommands"`
+		// Allow and Deny are the client subnets allowed and denied to query the server.
+		// Denied subnets win, all the clients are allowed without allowed subnets.
+		Allow []string `yaml:"allow"`
+		Deny  []string `yaml:"deny"`
+		// DenyAction is the response to the denied clients: refused or drop. Default is refused.
+		DenyAction string `yaml:"denyAction"`
+		// CommandsAllow and CommandsDeny are the client subnets allowed and denied to send the clear/ commands.
+		CommandsAllow []string `yaml:"commandsAllow"`
+		CommandsDeny  []string `yaml:"commandsDeny"`
+		// RateLimit limits the queries of each client, RRL limits the identical responses.
+		RateLimit   RateLimit   `yaml:"rateLimit"`
+		RRL         RRL         `yaml:"rrl"`
+		LogLevel    string      `yaml:"logLevel"`
+		HealthCheck HealthCheck `yaml:"healthCheck"`
+		// TLS and HTTPS are the optional DNS-over-TLS and DNS-over-HTTPS listeners.
+		TLS   TLSListener   `yaml:"tls"`
+		HTTPS HTTPSListener `yaml:"https"`
+
+		acl         *ACL
+		commandsACL *ACL
+	}
+
+	HealthCheck struct {
+		Enabled bool `yaml:"enabled"`
+		// Interval is the interval between two probes of the upstream servers, in seconds. Default is 30.
+		Interval int `yaml:"interval"`
+		// Domain is the name queried (NS) to probe the servers. Default is the root.
+		Domain string `yaml:"domain"`
+		// FailureThreshold is the number of consecutive failures before a server is
+		// considered unhealthy and skipped until it answers a probe. Default is 3.
+		FailureThreshold int `yaml:"failureThreshold"`
+	}
+
+	TLSListener struct {
+		Enabled bool `yaml:"enabled"`
+		// Host defaults to the host of the server.
+		Host     string `yaml:"host"`
+		Port     int    `yaml:"port"`
+		CertFile string `yaml:"certFile"`
+		KeyFile  string `yaml:"keyFile"`
+	}
+
+	HTTPSListener struct {
+		TLSListener `yaml:",inline"`
+		// Path is the path of the DoH endpoint. Default is /dns-query.
+		Path string `yaml:"path"`
 	}
 
 	Cache struct {
 		Enabled bool   `yaml:"enabled"`
 		Path    string `yaml:"path"`
+		// MinTTL and MaxTTL bound the upstream TTLs, in seconds.
+		MinTTL int `yaml:"minTTL"`
+		MaxTTL int `yaml:"maxTTL"`
+		// NegativeTTL caps the TTL of cached NXDOMAIN and NODATA answers, in seconds.
+		NegativeTTL int `yaml:"negativeTTL"`
+		// MaxEntries and MaxBytes bound the size of the cache. Default is no limit.
+		MaxEntries int `yaml:"maxEntries"`
+		MaxBytes   int `yaml:"maxBytes"`
+		// Eviction is the policy used to evict entries when the cache is full: lru or lfu. Default is lru.
+		Eviction string `yaml:"eviction"`
+		// Shards is the number of independently locked parts of the cache. Default is 16.
+		Shards int `yaml:"shards"`
+		// ServeStale answers from the expired entries when the upstreams fail.
+		ServeStale ServeStale `yaml:"serveStale"`
+		// Prefetch resolves the popular entries again before they expire.
+		Prefetch Prefetch `yaml:"prefetch"`
+	}
+
+	Admin struct {
+		Enabled bool   `yaml:"enabled"`
+		Host    string `yaml:"host"`
+		Port    int    `yaml:"port"`
+		// Token is the bearer token required to call the admin API.
+		Token string `yaml:"token"`
+	}
+
+	Metrics struct {
+		Enabled bool   `yaml:"enabled"`
+		Host    string `yaml:"host"`
+		Port    int    `yaml:"port"`
+		// Path is the path of the Prometheus endpoint. Default is /metrics.
+		Path string `yaml:"path"`
 	}
 
 	Config struct {
-		mu        sync.RWMutex
 		Server    Server     `yaml:"server"`
 		Cache     Cache      `yaml:"cache"`
+		Metrics   Metrics    `yaml:"metrics"`
+		Admin     Admin      `yaml:"admin"`
 		Upstreams []Upstream `yaml:"upstreams"`
+		// Zones are the local zones answered before routing.
+		Zones []Zone `yaml:"zones"`
+		// Records are static records in zone file format, answered before routing.
+		Records []string `yaml:"records"`
+		// HostsFiles are files in /etc/hosts format, answered before routing.
+		HostsFiles []string `yaml:"hostsFiles"`
+		// Blocklists are the lists of the blocked domains.
+		Blocklists Blocklists `yaml:"blocklists"`
+		// RPZ are the response policy zones.
+		RPZ RPZ `yaml:"rpz"`
 		// ExternalUpstreams is a list of URLs to fetch the upstreams from.
 		ExternalUpstreams         []ExternalUpstreamConfig `yaml:"externalUpstreams"`
 		ExternalUpstreamsInterval int                      `yaml:"externalUpstreamsInterval"`
@@ -68,46 +231,142 @@ type (
 	}
 )
 
-func (u *Upstream) CompileRegex() {
+// CompileRegex compiles the regular expressions of the upstream.
+func (u *Upstream) CompileRegex() error {
 	u.Regex = make([]*regexp.Regexp, len(u.HostRegex))
 	for i, r := range u.HostRegex {
-		u.Regex[i] = regexp.MustCompile(r)
+		re, err := regexp.Compile(r)
+		if err != nil {
+			return fmt.Errorf("upstream %s: invalid regex %q: %w", u.Name, r, err)
+		}
+		u.Regex[i] = re
 	}
+
+	return nil
 }
 
-func (u *Upstream) CompileDNSServers() {
-	for i, server := range u.DNSServers {
-		u.DNSServers[i] = net.JoinHostPort(server, "53")
+// CompileDomains normalizes the domains, suffixes and wildcards of the upstream and checks the patterns.
+func (u *Upstream) CompileDomains() error {
+	for _, names := range [][]string{u.Domains, u.Suffixes, u.Wildcards} {
+		for i, name := range names {
+			names[i] = strings.ToLower(dns.Fqdn(name))
+		}
+	}
+
+	for _, w := range u.Wildcards {
+		for _, label := range dns.SplitDomainName(w) {
+			if _, err := path.Match(label, ""); err != nil {
+				return fmt.Errorf("upstream %s: invalid wildcard %q: %w", u.Name, w, err)
+			}
+		}
 	}
+
+	return nil
+}
+
+// GetStrategy returns the strategy used to select the servers.
+func (u *Upstream) GetStrategy() string {
+	if u.Strategy == "" {
+		return StrategySequential
+	}
+
+	return u.Strategy
 }
 
-func (m *MatchDomains) Add(regex *regexp.Regexp, servers []string) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	m.Regex[regex] = servers
+// GetTimeout returns the timeout of each attempt to the servers, or def if the upstream has none.
+func (u *Upstream) GetTimeout(def time.Duration) time.Duration {
+	if u.Timeout <= 0 {
+		return def
+	}
+
+	return time.Duration(u.Timeout) * time.Millisecond
+}
+
+// checkStrategy returns an error if the strategy is unknown.
+func checkStrategy(strategy string) error {
+	switch strategy {
+	case "", StrategySequential, StrategyParallel, StrategyRoundRobin, StrategyRandom, StrategyLowestLatency:
+		return nil
+	default:
+		return fmt.Errorf("unknown strategy %q", strategy)
+	}
 }
 
-func (m *MatchDomains) Get(domain string) []string {
-	for regex, servers := range m.Regex {
-		if regex.MatchString(domain) {
-			return servers
+// CompileDNSServers checks the strategy and normalizes the addresses of the upstream DNS servers.
+func (u *Upstream) CompileDNSServers() error {
+	if err := checkStrategy(u.Strategy); err != nil {
+		return fmt.Errorf("upstream %s: %w", u.Name, err)
+	}
+
+	for i, server := range u.DNSServers {
+		s, err := compileDNSServer(server)
+		if err != nil {
+			return fmt.Errorf("upstream %s: %w", u.Name, err)
 		}
+		u.DNSServers[i] = s
 	}
+
 	return nil
 }
 
-// Clear clears the MatchDomains map.
-func (m *MatchDomains) Clear() {
-	m.Regex = make(map[*regexp.Regexp][]string)
-}
+// compileDNSServer normalizes the address of an upstream DNS server.
+// Plain DNS servers default to port 53. Servers with a scheme are URLs like
+// tls://1.1.1.1:853#cloudflare-dns.com or https://dns.example/dns-query and are kept as is.
+func compileDNSServer(server string) (string, error) {
+	if !strings.Contains(server, "://") {
+		if _, _, err := net.SplitHostPort(server); err == nil {
+			return server, nil
+		}
+		return net.JoinHostPort(server, "53"), nil
+	}
+
+	u, err := url.Parse(server)
+	if err != nil {
+		return "", fmt.Errorf("invalid DNS server %q: %w", server, err)
+	}
 
-// Compute MatchDomains from the Upstreams.
-func (m *MatchDomains) ComputeMatchDomains() {
-	m.Clear()
-	for _, u := range Cfg.Upstreams {
-		for _, r := range u.Regex {
-			m.Add(r, u.DNSServers)
+	switch u.Scheme {
+	case SchemeTLS, SchemeHTTPS:
+		if u.Host == "" {
+			return "", fmt.Errorf("invalid DNS server %q: missing host", server)
 		}
+	default:
+		return "", fmt.Errorf("invalid DNS server %q: unsupported scheme %q", server, u.Scheme)
+	}
+
+	return server, nil
+}
+
+// GetUpstreams returns the upstreams of the configuration file followed by
+// the upstreams of the external sources, in the order the sources are declared.
+func (c *Config) GetUpstreams() []Upstream {
+	upstreams := slices.Clone(c.Upstreams)
+	for _, e := range c.ExternalUpstreams {
+		upstreams = append(upstreams, eudb.Get(e.URL)...)
+	}
+
+	return upstreams
+}
+
+// defaultUpstreamTimeout is the default timeout of each attempt to an upstream server.
+const defaultUpstreamTimeout = 2 * time.Second
+
+// GetUpstreamTimeout returns the timeout of each attempt to an upstream server.
+func (s *Server) GetUpstreamTimeout() time.Duration {
+	if s.UpstreamTimeout <= 0 {
+		return defaultUpstreamTimeout
+	}
+
+	return time.Duration(s.UpstreamTimeout) * time.Millisecond
+}
+
+// GetDefaultUpstream returns the default upstream servers as an upstream.
+func (s *Server) GetDefaultUpstream() *Upstream {
+	return &Upstream{
+		Name:       "default",
+		DNSServers: s.DefaultUpstream,
+		Strategy:   s.DefaultUpstreamStrategy,
+		Timeout:    s.UpstreamTimeout,
 	}
 }
 
@@ -116,6 +375,118 @@ func (s *Server) GetListenAddress() string {
 	return fmt.Sprintf("%s:%d", s.Host, s.Port)
 }
 
+// Defaults of the upstream health checks.
+const (
+	defaultHealthCheckInterval         = 30 * time.Second
+	defaultHealthCheckFailureThreshold = 3
+)
+
+// GetInterval returns the interval between two probes of the upstream servers.
+func (h *HealthCheck) GetInterval() time.Duration {
+	if h.Interval <= 0 {
+		return defaultHealthCheckInterval
+	}
+
+	return time.Duration(h.Interval) * time.Second
+}
+
+// GetDomain returns the name queried to probe the servers.
+func (h *HealthCheck) GetDomain() string {
+	if h.Domain == "" {
+		return "."
+	}
+
+	return dns.Fqdn(h.Domain)
+}
+
+// GetFailureThreshold returns the number of consecutive failures before a server is unhealthy.
+func (h *HealthCheck) GetFailureThreshold() int {
+	if h.FailureThreshold <= 0 {
+		return defaultHealthCheckFailureThreshold
+	}
+
+	return h.FailureThreshold
+}
+
+// Default ports and path of the encrypted listeners.
+const (
+	defaultTLSPort   = 853
+	defaultHTTPSPort = 443
+	defaultHTTPSPath = "/dns-query"
+)
+
+// GetTLSListenAddress returns the address the DNS-over-TLS listener listens on.
+func (s *Server) GetTLSListenAddress() string {
+	return s.TLS.listenAddress(s.Host, defaultTLSPort)
+}
+
+// GetHTTPSListenAddress returns the address the DNS-over-HTTPS listener listens on.
+func (s *Server) GetHTTPSListenAddress() string {
+	return s.HTTPS.listenAddress(s.Host, defaultHTTPSPort)
+}
+
+// listenAddress returns the address to listen on, with the given defaults.
+func (l *TLSListener) listenAddress(defaultHost string, defaultPort int) string {
+	host := l.Host
+	if host == "" {
+		host = defaultHost
+	}
+
+	port := l.Port
+	if port == 0 {
+		port = defaultPort
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// GetPath returns the path of the DoH endpoint.
+func (l *HTTPSListener) GetPath() string {
+	if l.Path == "" {
+		return defaultHTTPSPath
+	}
+
+	return l.Path
+}
+
+// defaultAdminPort is the default port of the admin API.
+const defaultAdminPort = 8053
+
+// GetListenAddress returns the address the admin API listens on.
+func (a *Admin) GetListenAddress() string {
+	port := a.Port
+	if port == 0 {
+		port = defaultAdminPort
+	}
+
+	return net.JoinHostPort(a.Host, strconv.Itoa(port))
+}
+
+// Defaults of the metrics listener.
+const (
+	defaultMetricsPort = 9153
+	defaultMetricsPath = "/metrics"
+)
+
+// GetListenAddress returns the address the metrics listener listens on.
+func (m *Metrics) GetListenAddress() string {
+	port := m.Port
+	if port == 0 {
+		port = defaultMetricsPort
+	}
+
+	return net.JoinHostPort(m.Host, strconv.Itoa(port))
+}
+
+// GetPath returns the path of the Prometheus endpoint.
+func (m *Metrics) GetPath() string {
+	if m.Path == "" {
+		return defaultMetricsPath
+	}
+
+	return m.Path
+}
+
 // GetLogLevel returns the log level.
 func (s *Server) GetLogLevel() zerolog.Level {
 	switch s.LogLevel {
@@ -132,7 +503,62 @@ func (s *Server) GetLogLevel() zerolog.Level {
 	}
 }
 
+// GetMinTTL returns the minimum duration an entry is kept in the cache.
+func (c *Cache) GetMinTTL() time.Duration {
+	return time.Duration(c.MinTTL) * time.Second
+}
+
+// GetMaxTTL returns the maximum duration an entry is kept in the cache.
+func (c *Cache) GetMaxTTL() time.Duration {
+	return time.Duration(c.MaxTTL) * time.Second
+}
+
+// defaultNegativeTTL is the default cap of the negative answers TTL.
+const defaultNegativeTTL = time.Hour
+
+// GetNegativeTTL returns the maximum duration a negative answer is kept in the cache.
+func (c *Cache) GetNegativeTTL() time.Duration {
+	if c.NegativeTTL <= 0 {
+		return defaultNegativeTTL
+	}
+
+	return time.Duration(c.NegativeTTL) * time.Second
+}
+
+// GetEviction returns the policy used to evict entries when the cache is full.
+func (c *Cache) GetEviction() string {
+	if c.Eviction == "" {
+		return EvictionLRU
+	}
+
+	return c.Eviction
+}
+
+// defaultCacheShards is the default number of cache shards.
+const defaultCacheShards = 16
+
+// GetShards returns the number of cache shards.
+func (c *Cache) GetShards() int {
+	if c.Shards <= 0 {
+		return defaultCacheShards
+	}
+
+	return c.Shards
+}
+
+// checkEviction returns an error if the eviction policy is unknown.
+func checkEviction(eviction string) error {
+	switch eviction {
+	case "", EvictionLRU, EvictionLFU:
+		return nil
+	default:
+		return fmt.Errorf("unknown cache eviction policy %q", eviction)
+	}
+}
+
 // ReadConfig reads the configuration from the given file.
+// The configuration is checked and compiled before it replaces the current one,
+// which is kept when the file is invalid.
 func ReadConfig(file string) error {
 	// Open the file
 	osFile, err := os.Open(file)
@@ -141,36 +567,101 @@ func ReadConfig(file string) error {
 	}
 	defer osFile.Close()
 
-	Cfg.mu.Lock()
-
 	// Decode the file
-	if err := yaml.NewDecoder(osFile).Decode(Cfg); err != nil {
+	next := &Config{}
+	if err := yaml.NewDecoder(osFile).Decode(next); err != nil {
 		return err
 	}
 
-	for i, server := range Cfg.Server.DefaultUpstream {
-		Cfg.Server.DefaultUpstream[i] = net.JoinHostPort(server, "53")
+	if err := next.compile(); err != nil {
+		return err
 	}
 
-	// Compile the regex
-	// TODO Parallelize this
-	for i := range Cfg.Upstreams {
-		Cfg.Upstreams[i].CompileRegex()
-		Cfg.Upstreams[i].CompileDNSServers()
+	zones, err := compileLocalZones(next.Zones, next.Records)
+	if err != nil {
+		return err
+	}
+
+	hosts, err := readHosts(next.HostsFiles)
+	if err != nil {
+		return err
 	}
 
-	Cfg.mu.Unlock()
+	current.Store(next)
+	Lz.set(zones)
+	Hosts.set(hosts)
+	watchHostsFiles(next.HostsFiles)
 
 	Md.ComputeMatchDomains()
 	LoadExternalUpstreams()
+	LoadBlocklists()
+	LoadRPZ()
 
 	// Setup log level
-	log.Info().Msgf("Setting log level to %s", Cfg.Server.LogLevel)
-	zerolog.SetGlobalLevel(Cfg.Server.GetLogLevel())
+	log.Info().Msgf("Setting log level to %s", next.Server.LogLevel)
+	zerolog.SetGlobalLevel(next.Server.GetLogLevel())
 
 	return nil
 }
 
+// compile checks the configuration and compiles its upstreams and access lists.
+func (c *Config) compile() error {
+	if err := checkRoutingMode(c.Server.RoutingMode); err != nil {
+		return err
+	}
+
+	if err := c.Server.compileACLs(); err != nil {
+		return err
+	}
+
+	if err := checkRateLimits(c.Server); err != nil {
+		return err
+	}
+
+	if err := checkEviction(c.Cache.Eviction); err != nil {
+		return err
+	}
+
+	if err := checkPrefetch(c.Cache.Prefetch); err != nil {
+		return err
+	}
+
+	if err := checkStrategy(c.Server.DefaultUpstreamStrategy); err != nil {
+		return fmt.Errorf("default upstream: %w", err)
+	}
+
+	for i, server := range c.Server.DefaultUpstream {
+		s, err := compileDNSServer(server)
+		if err != nil {
+			return fmt.Errorf("default upstream: %w", err)
+		}
+		c.Server.DefaultUpstream[i] = s
+	}
+
+	// Compile the regex
+	// TODO Parallelize this
+	for i := range c.Upstreams {
+		if err := c.Upstreams[i].CompileRegex(); err != nil {
+			return err
+		}
+		if err := c.Upstreams[i].CompileDomains(); err != nil {
+			return err
+		}
+		if err := c.Upstreams[i].CompileConditions(); err != nil {
+			return err
+		}
+		if err := c.Upstreams[i].CompileDNSServers(); err != nil {
+			return err
+		}
+	}
+
+	if err := checkBlocklists(c.Blocklists); err != nil {
+		return err
+	}
+
+	return checkRPZ(c.RPZ)
+}
+
 // Watch will watch the configuration file for changes.
 func WatchConfigFile(file string, done chan bool) {
 	// creates a new file watcher
@@ -189,6 +680,9 @@ func WatchConfigFile(file string, done chan bool) {
 					log.Info().Msg("Config file changed. Loading new configuration.")
 					if err := ReadConfig(file); err != nil {
 						log.Error().Err(err).Msg("Failed to read config file.")
+						metrics.ConfigReloads.WithLabelValues(metrics.ResultError).Inc()
+					} else {
+						metrics.ConfigReloads.WithLabelValues(metrics.ResultSuccess).Inc()
 					}
 				}
 				// watch for errors
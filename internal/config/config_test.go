@@ -0,0 +1,44 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadConfigKeepsConfigOnError(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	write := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(file, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("server:\n  defaultUpstream: [192.0.2.1]\n")
+	if err := ReadConfig(file); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{name: "invalid regex", content: "server:\n  defaultUpstream: [192.0.2.2]\nupstreams:\n  - name: bad\n    servers: [192.0.2.3]\n    regex: ['(']\n"},
+		{name: "invalid routing mode", content: "server:\n  defaultUpstream: [192.0.2.2]\n  routingMode: typo\n"},
+		{name: "invalid yaml", content: "server: [\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			write(tt.content)
+			if err := ReadConfig(file); err == nil {
+				t.Fatal("got no error")
+			}
+
+			if got := Get().Server.DefaultUpstream; len(got) != 1 || got[0] != "192.0.2.1:53" {
+				t.Errorf("got default upstream %v, want the previous [192.0.2.1:53]", got)
+			}
+		})
+	}
+}
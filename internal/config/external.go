@@ -3,12 +3,15 @@ package config
 import (
 	"crypto/sha256"
 	"encoding/hex"
+	"fmt"
 	"sync"
 	"time"
 
 	"github.com/go-resty/resty/v2"
 	"github.com/rs/zerolog/log"
 	"gopkg.in/yaml.v3"
+
+	"github.com/azrod/dnsr/internal/metrics"
 )
 
 type HashDBExternal struct {
@@ -20,6 +23,16 @@ var hdbe = HashDBExternal{
 	db: make(map[string]string),
 }
 
+// ExternalUpstreamsDB holds the upstreams fetched from each external source.
+type ExternalUpstreamsDB struct {
+	mu sync.RWMutex
+	db map[string][]Upstream
+}
+
+var eudb = ExternalUpstreamsDB{
+	db: make(map[string][]Upstream),
+}
+
 // LoadExternalUpstreams loads the external upstreams from the URLs provided in the configuration file.
 func LoadExternalUpstreams() {
 	// WaitGroup to wait for all the external upstreams to be fetched
@@ -29,59 +42,63 @@ func LoadExternalUpstreams() {
 		updated bool
 	)
 
-	for i, url := range Cfg.ExternalUpstreams {
+	sources := Get().ExternalUpstreams
+	for i, url := range sources {
 		wg.Add(1)
 		go func(url ExternalUpstreamConfig, i int) {
 			defer wg.Done()
 
-			client := resty.New()
-			client.SetTimeout(5 * time.Second)
-			log.Info().Msgf("Fetching upstreams (%d/%d) from %s", i+1, len(Cfg.ExternalUpstreams), url.URL)
-
-			c := client.R().
-				SetHeader("Accept", "application/yaml")
-
-			if url.Token != "" {
-				c.SetAuthToken(url.Token)
-			}
-
-			if url.Username != "" && url.Password != "" {
-				c.SetBasicAuth(url.Username, url.Password)
-			}
+			log.Info().Msgf("Fetching upstreams (%d/%d) from %s", i+1, len(sources), url.URL)
 
-			resp, err := c.Get(url.URL)
+			body, err := fetchExternal(url, "application/yaml")
 			if err != nil {
-				log.Error().Err(err).Msgf("Error fetching upstreams from %s", url)
-				return
-			}
-
-			if resp.StatusCode() != 200 {
-				log.Error().Msgf("Error fetching upstreams from %s: %s", url, resp.Status())
+				log.Error().Err(err).Msgf("Error fetching upstreams from %s", url.URL)
+				metrics.ExternalUpstreamsFetches.WithLabelValues(url.URL, metrics.ResultError).Inc()
 				return
 			}
 
 			var external ExternalUpstream
 
-			if hdbe.HasUpdated(url.URL, resp.Body()) {
-				if err := yaml.Unmarshal(resp.Body(), &external); err != nil {
+			if hdbe.HasUpdated(url.URL, body) {
+				if err := yaml.Unmarshal(body, &external); err != nil {
 					log.Error().Err(err).Msgf("Error decoding upstreams from %s", url.URL)
+					metrics.ExternalUpstreamsFetches.WithLabelValues(url.URL, metrics.ResultError).Inc()
 					return
 				}
 
 				log.Info().Msgf("Found %d upstream(s) from %s", len(external.Upstreams), url.URL)
 
+				upstreams := make([]Upstream, 0, len(external.Upstreams))
 				for _, u := range external.Upstreams {
-					u.CompileRegex()
-					u.CompileDNSServers()
-					Cfg.mu.Lock()
-					Cfg.Upstreams = append(Cfg.Upstreams, u)
-					Cfg.mu.Unlock()
+					if err := u.CompileRegex(); err != nil {
+						log.Error().Err(err).Msgf("Ignoring upstream from %s", url.URL)
+						continue
+					}
+					if err := u.CompileDomains(); err != nil {
+						log.Error().Err(err).Msgf("Ignoring upstream from %s", url.URL)
+						continue
+					}
+					if err := u.CompileConditions(); err != nil {
+						log.Error().Err(err).Msgf("Ignoring upstream from %s", url.URL)
+						continue
+					}
+					if err := u.CompileDNSServers(); err != nil {
+						log.Error().Err(err).Msgf("Ignoring upstream from %s", url.URL)
+						continue
+					}
+					upstreams = append(upstreams, u)
 				}
 
+				// The upstreams of the source replace the ones previously fetched
+				eudb.Set(url.URL, upstreams)
+
 				mu.Lock()
 				updated = true
 				mu.Unlock()
-				hdbe.Update(url.URL, hdbe.ComputeHash(resp.Body()))
+				hdbe.Update(url.URL, hdbe.ComputeHash(body))
+				metrics.ExternalUpstreamsFetches.WithLabelValues(url.URL, metrics.ResultSuccess).Inc()
+			} else {
+				metrics.ExternalUpstreamsFetches.WithLabelValues(url.URL, metrics.ResultUnchanged).Inc()
 			}
 		}(url, i)
 	}
@@ -92,6 +109,34 @@ func LoadExternalUpstreams() {
 	}
 }
 
+// fetchExternal fetches the content of an external source with its credentials.
+func fetchExternal(src ExternalUpstreamConfig, accept string) ([]byte, error) {
+	client := resty.New()
+	client.SetTimeout(5 * time.Second)
+
+	c := client.R().
+		SetHeader("Accept", accept)
+
+	if src.Token != "" {
+		c.SetAuthToken(src.Token)
+	}
+
+	if src.Username != "" && src.Password != "" {
+		c.SetBasicAuth(src.Username, src.Password)
+	}
+
+	resp, err := c.Get(src.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode() != 200 {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status())
+	}
+
+	return resp.Body(), nil
+}
+
 // ComputeHash computes the hash of the external upstream.
 func (h *HashDBExternal) ComputeHash(upstreamContent []byte) string {
 	return hex.EncodeToString(h.hash(upstreamContent))
@@ -122,3 +167,17 @@ func (h *HashDBExternal) HasUpdated(url string, upstreamContent []byte) bool {
 	defer h.mu.RUnlock()
 	return !h.exist(url) || h.db[url] != h.ComputeHash(upstreamContent)
 }
+
+// Set sets the upstreams fetched from the external source.
+func (e *ExternalUpstreamsDB) Set(url string, upstreams []Upstream) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.db[url] = upstreams
+}
+
+// Get returns the upstreams fetched from the external source.
+func (e *ExternalUpstreamsDB) Get(url string) []Upstream {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.db[url]
+}
@@ -0,0 +1,220 @@
+package config
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/miekg/dns"
+	"github.com/rs/zerolog/log"
+)
+
+// hostsTTL is the TTL of the answers from the hosts files.
+const hostsTTL = 60
+
+var (
+	Hosts = &HostsDB{}
+
+	// hostsWatcher watches the directories of the hosts files, set by WatchHostsFiles.
+	hostsWatcher   *fsnotify.Watcher
+	hostsWatcherMu sync.Mutex
+)
+
+// HostsDB holds the names and addresses of the hosts files.
+type HostsDB struct {
+	mu    sync.RWMutex
+	names map[string][]net.IP
+	// reverse holds the names of each address, by reverse name (in-addr.arpa. or ip6.arpa.).
+	reverse map[string][]string
+}
+
+// Load reads the hosts files, the names of all the files are merged.
+func (h *HostsDB) Load(files []string) error {
+	next, err := readHosts(files)
+	if err != nil {
+		return err
+	}
+
+	h.set(next)
+
+	return nil
+}
+
+// readHosts reads the hosts files in a new database.
+func readHosts(files []string) (*HostsDB, error) {
+	var (
+		names   = make(map[string][]net.IP)
+		reverse = make(map[string][]string)
+	)
+
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+
+		err = parseHosts(f, names, reverse)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &HostsDB{names: names, reverse: reverse}, nil
+}
+
+// set replaces the names and addresses with those of next.
+func (h *HostsDB) set(next *HostsDB) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.names = next.names
+	h.reverse = next.reverse
+}
+
+// parseHosts reads a file in /etc/hosts format: an address followed by its canonical name and aliases.
+// The PTR record of the address points to the canonical name.
+func parseHosts(r io.Reader, names map[string][]net.IP, reverse map[string][]string) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+
+		// Zone indexes of link-local addresses are ignored
+		addr, _, _ := strings.Cut(fields[0], "%")
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			continue
+		}
+
+		for _, n := range fields[1:] {
+			name := strings.ToLower(dns.Fqdn(n))
+			if !slices.ContainsFunc(names[name], ip.Equal) {
+				names[name] = append(names[name], ip)
+			}
+		}
+
+		rev, err := dns.ReverseAddr(ip.String())
+		if err != nil {
+			continue
+		}
+		if canonical := strings.ToLower(dns.Fqdn(fields[1])); !slices.Contains(reverse[rev], canonical) {
+			reverse[rev] = append(reverse[rev], canonical)
+		}
+	}
+
+	return scanner.Err()
+}
+
+// Lookup answers the A, AAAA and PTR queries from the hosts files.
+// It returns false if the name is not in the hosts files or for other query types.
+func (h *HostsDB) Lookup(name string, qtype uint16) (LocalAnswer, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	var answer LocalAnswer
+	name = strings.ToLower(dns.Fqdn(name))
+	hdr := dns.RR_Header{Name: name, Rrtype: qtype, Class: dns.ClassINET, Ttl: hostsTTL}
+
+	switch qtype {
+	case dns.TypeA, dns.TypeAAAA:
+		ips, ok := h.names[name]
+		if !ok {
+			return answer, false
+		}
+
+		// A name without address of the type has no data
+		for _, ip := range ips {
+			switch ip4 := ip.To4(); {
+			case qtype == dns.TypeA && ip4 != nil:
+				answer.Answer = append(answer.Answer, &dns.A{Hdr: hdr, A: ip4})
+			case qtype == dns.TypeAAAA && ip4 == nil:
+				answer.Answer = append(answer.Answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+			}
+		}
+	case dns.TypePTR:
+		targets, ok := h.reverse[name]
+		if !ok {
+			return answer, false
+		}
+
+		for _, target := range targets {
+			answer.Answer = append(answer.Answer, &dns.PTR{Hdr: hdr, Ptr: target})
+		}
+	default:
+		return answer, false
+	}
+
+	return answer, true
+}
+
+// WatchHostsFiles reloads the hosts files when they change.
+// The directories are watched so that the files replaced by editors are still watched.
+func WatchHostsFiles(done chan bool) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Error().Err(err).Msg("Error creating hosts files watcher.")
+		return
+	}
+
+	hostsWatcherMu.Lock()
+	hostsWatcher = watcher
+	hostsWatcherMu.Unlock()
+
+	go func() {
+		for {
+			select {
+			case event := <-watcher.Events:
+				if !event.Has(fsnotify.Write) && !event.Has(fsnotify.Create) && !event.Has(fsnotify.Rename) && !event.Has(fsnotify.Remove) {
+					continue
+				}
+
+				files := Get().HostsFiles
+
+				if !slices.ContainsFunc(files, func(f string) bool { return filepath.Clean(f) == filepath.Clean(event.Name) }) {
+					continue
+				}
+
+				log.Info().Msgf("Hosts file %s changed. Loading hosts files.", event.Name)
+				if err := Hosts.Load(files); err != nil {
+					log.Error().Err(err).Msg("Failed to read hosts files.")
+				}
+			case err := <-watcher.Errors:
+				log.Error().Err(err).Msg("Error watching hosts files.")
+			case <-done:
+				hostsWatcherMu.Lock()
+				hostsWatcher = nil
+				hostsWatcherMu.Unlock()
+				watcher.Close()
+				return
+			}
+		}
+	}()
+
+	watchHostsFiles(Get().HostsFiles)
+}
+
+// watchHostsFiles adds the directories of the hosts files to the watcher, if it is started.
+func watchHostsFiles(files []string) {
+	hostsWatcherMu.Lock()
+	defer hostsWatcherMu.Unlock()
+
+	if hostsWatcher == nil {
+		return
+	}
+
+	for _, f := range files {
+		if err := hostsWatcher.Add(filepath.Dir(filepath.Clean(f))); err != nil {
+			log.Error().Err(err).Msgf("Error adding hosts file %s to watcher.", f)
+		}
+	}
+}
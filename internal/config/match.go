@@ -0,0 +1,268 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// Routing modes used to select the upstream of a domain matched by several upstreams.
+const (
+	// RoutingOrdered selects the first matching upstream, by priority then declaration order.
+	RoutingOrdered = "ordered"
+	// RoutingLongestSuffix selects the upstream with the longest match,
+	// then by priority and declaration order.
+	RoutingLongestSuffix = "longest-suffix"
+)
+
+// Listeners the queries are received on.
+const (
+	ListenerUDP   = "udp"
+	ListenerTCP   = "tcp"
+	ListenerTLS   = "tls"
+	ListenerHTTPS = "https"
+)
+
+type (
+	// Query is what the routing rules are matched against.
+	Query struct {
+		Name     string
+		Qtype    uint16
+		Client   net.IP
+		Listener string
+	}
+
+	// MatchDomains is the routing table of the upstreams.
+	// The routes are evaluated in order: the upstreams of the configuration file first,
+	// then the upstreams of the external sources, sorted by priority.
+	// The domain, suffix and wildcard routes are indexed in a trie, the regex routes are evaluated one by one.
+	MatchDomains struct {
+		mu     sync.RWMutex
+		mode   string
+		routes []Route
+		trie   *domainTrie
+		// regexes are the indexes of the regex routes.
+		regexes []int
+	}
+
+	// Route is a routing rule of MatchDomains.
+	Route struct {
+		// Kind is the kind of the rule: regex, domain, suffix or wildcard.
+		Kind    string
+		Pattern string
+		// Regex is the compiled pattern of the regex rules.
+		Regex    *regexp.Regexp
+		Upstream *Upstream
+	}
+)
+
+// checkRoutingMode returns an error if the routing mode is unknown.
+func checkRoutingMode(mode string) error {
+	switch mode {
+	case "", RoutingOrdered, RoutingLongestSuffix:
+		return nil
+	default:
+		return fmt.Errorf("unknown routing mode %q", mode)
+	}
+}
+
+// CompileConditions parses the query types and client subnets of the upstream and checks the listeners.
+func (u *Upstream) CompileConditions() error {
+	u.Types = make([]uint16, 0, len(u.Qtypes))
+	for _, t := range u.Qtypes {
+		qtype, ok := dns.StringToType[strings.ToUpper(t)]
+		if !ok {
+			return fmt.Errorf("upstream %s: unknown query type %q", u.Name, t)
+		}
+		u.Types = append(u.Types, qtype)
+	}
+
+	networks, err := parseSubnets(u.Clients)
+	if err != nil {
+		return fmt.Errorf("upstream %s: %w", u.Name, err)
+	}
+	u.Networks = networks
+
+	for _, l := range u.Listeners {
+		switch l {
+		case ListenerUDP, ListenerTCP, ListenerTLS, ListenerHTTPS:
+		default:
+			return fmt.Errorf("upstream %s: unknown listener %q", u.Name, l)
+		}
+	}
+
+	return nil
+}
+
+// HasClientConditions returns true if the upstream depends on the client or the listener of the query.
+// The answers of these upstreams differ from a client to another and are not shared in the cache.
+func (u *Upstream) HasClientConditions() bool {
+	return len(u.Networks) > 0 || len(u.Listeners) > 0
+}
+
+// CacheID returns the identifier of the answers of the upstream in the cache, empty when they are shared.
+// The answers of the upstreams depending on the client are only shared by the upstreams with the same servers.
+func (u *Upstream) CacheID() string {
+	if !u.HasClientConditions() {
+		return ""
+	}
+
+	return strings.Join(u.DNSServers, ",")
+}
+
+// GetByCacheID returns the first upstream with the cache identifier, or nil if there is none.
+func (m *MatchDomains) GetByCacheID(id string) *Upstream {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, r := range m.routes {
+		if r.Upstream.CacheID() == id {
+			return r.Upstream
+		}
+	}
+
+	return nil
+}
+
+// Accepts returns true if the query meets the query type, client and listener conditions of the upstream.
+func (u *Upstream) Accepts(q Query) bool {
+	if len(u.Types) > 0 && !slices.Contains(u.Types, q.Qtype) {
+		return false
+	}
+
+	if len(u.Listeners) > 0 && !slices.Contains(u.Listeners, q.Listener) {
+		return false
+	}
+
+	if len(u.Networks) > 0 && !slices.ContainsFunc(u.Networks, func(n *net.IPNet) bool {
+		return q.Client != nil && n.Contains(q.Client)
+	}) {
+		return false
+	}
+
+	return true
+}
+
+// Get returns the upstream of the query, or nil if no upstream matches it.
+func (m *MatchDomains) Get(q Query) *Upstream {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if len(m.routes) == 0 {
+		return nil
+	}
+
+	var (
+		longest = m.mode == RoutingLongestSuffix
+		best    = -1
+		bestLen = -1
+	)
+
+	// consider keeps the best route, on equal length the first one wins
+	consider := func(route, length int) {
+		if !m.routes[route].Upstream.Accepts(q) {
+			return
+		}
+
+		switch {
+		case best == -1,
+			longest && length > bestLen,
+			(!longest || length == bestLen) && route < best:
+			best, bestLen = route, length
+		}
+	}
+
+	name := dns.Fqdn(q.Name)
+	offsets := dns.Split(name)
+	m.trie.lookup(name, func(route, labels int) {
+		// The length of the matched part of the name
+		length := 0
+		if labels > 0 {
+			length = len(name) - offsets[len(offsets)-labels]
+		}
+		consider(route, length)
+	})
+
+	for _, i := range m.regexes {
+		if !longest && best != -1 && i > best {
+			break
+		}
+
+		if loc := m.routes[i].Regex.FindStringIndex(q.Name); loc != nil {
+			consider(i, loc[1]-loc[0])
+		}
+	}
+
+	if best == -1 {
+		return nil
+	}
+
+	return m.routes[best].Upstream
+}
+
+// Routes returns the routing rules, in the order they are evaluated.
+func (m *MatchDomains) Routes() []Route {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return slices.Clone(m.routes)
+}
+
+// Clear clears the routing rules.
+func (m *MatchDomains) Clear() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.routes = nil
+	m.regexes = nil
+	m.trie = newDomainTrie()
+}
+
+// Compute MatchDomains from the Upstreams.
+func (m *MatchDomains) ComputeMatchDomains() {
+	cfg := Get()
+
+	var routes []Route
+	for _, u := range cfg.GetUpstreams() {
+		for _, r := range u.Regex {
+			routes = append(routes, Route{Kind: MatchRegex, Pattern: r.String(), Regex: r, Upstream: &u})
+		}
+		for _, d := range u.Domains {
+			routes = append(routes, Route{Kind: MatchDomain, Pattern: d, Upstream: &u})
+		}
+		for _, s := range u.Suffixes {
+			routes = append(routes, Route{Kind: MatchSuffix, Pattern: s, Upstream: &u})
+		}
+		for _, w := range u.Wildcards {
+			routes = append(routes, Route{Kind: MatchWildcard, Pattern: w, Upstream: &u})
+		}
+	}
+
+	// Stable sort keeps the declaration order of the upstreams with the same priority
+	slices.SortStableFunc(routes, func(a, b Route) int {
+		return b.Upstream.Priority - a.Upstream.Priority
+	})
+
+	trie := newDomainTrie()
+	var regexes []int
+	for i, r := range routes {
+		if r.Kind == MatchRegex {
+			regexes = append(regexes, i)
+		} else {
+			trie.insert(r.Pattern, r.Kind, i)
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.mode = cfg.Server.RoutingMode
+	m.routes = routes
+	m.trie = trie
+	m.regexes = regexes
+}
@@ -0,0 +1,126 @@
+package config
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestDomainTrieLookup(t *testing.T) {
+	trie := newDomainTrie()
+	rules := []struct {
+		name string
+		kind string
+	}{
+		{name: "example.com.", kind: MatchDomain},
+		{name: "example.com.", kind: MatchSuffix},
+		{name: "corp.example.com.", kind: MatchSuffix},
+		{name: "*.svc.example.com.", kind: MatchWildcard},
+		{name: "db-?.example.com.", kind: MatchWildcard},
+		{name: ".", kind: MatchSuffix},
+	}
+	for i, r := range rules {
+		trie.insert(r.name, r.kind, i)
+	}
+
+	tests := []struct {
+		name string
+		want []int
+	}{
+		{name: "example.com.", want: []int{5, 1, 0}},
+		{name: "www.example.com.", want: []int{5, 1}},
+		{name: "WWW.Example.COM.", want: []int{5, 1}},
+		{name: "host.corp.example.com.", want: []int{5, 1, 2}},
+		{name: "api.svc.example.com.", want: []int{5, 1, 3}},
+		{name: "a.api.svc.example.com.", want: []int{5, 1}},
+		{name: "db-1.example.com.", want: []int{5, 1, 4}},
+		{name: "db-10.example.com.", want: []int{5, 1}},
+		{name: "example.org.", want: []int{5}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []int
+			trie.lookup(tt.name, func(rule, _ int) {
+				got = append(got, rule)
+			})
+
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got rules %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// setTestUpstreams compiles the upstreams in the configuration and computes the routing table.
+func setTestUpstreams(t *testing.T, mode string, upstreams []Upstream) *MatchDomains {
+	t.Helper()
+
+	previous := Get()
+	t.Cleanup(func() { current.Store(previous) })
+
+	cfg := &Config{Server: Server{RoutingMode: mode}, Upstreams: upstreams}
+	if err := cfg.compile(); err != nil {
+		t.Fatal(err)
+	}
+	current.Store(cfg)
+
+	m := &MatchDomains{}
+	m.ComputeMatchDomains()
+
+	return m
+}
+
+func TestMatchDomainsGet(t *testing.T) {
+	upstreams := []Upstream{
+		{Name: "www", Domains: []string{"www.example.com"}},
+		{Name: "example", Suffixes: []string{"example.com"}},
+		{Name: "svc", Wildcards: []string{"*.svc.example.com"}},
+		{Name: "api", HostRegex: []string{`^api[0-9]+\.`}},
+		{Name: "corp", Suffixes: []string{"corp.example"}, Priority: 10},
+		{Name: "corp-low", Suffixes: []string{"corp.example"}},
+		{Name: "lab", Suffixes: []string{"lab.corp.example"}, Priority: 10},
+		{Name: "internal", HostRegex: []string{`\.internal\.$`}},
+		{Name: "org", Suffixes: []string{"example.org"}},
+		{Name: "org-regex", HostRegex: []string{`example\.org\.$`}, Priority: 5},
+	}
+
+	tests := []struct {
+		name        string
+		qname       string
+		wantOrdered string
+		wantLongest string
+	}{
+		{name: "exact before suffix", qname: "www.example.com.", wantOrdered: "www", wantLongest: "www"},
+		{name: "exact case insensitive", qname: "WWW.Example.COM.", wantOrdered: "www", wantLongest: "www"},
+		{name: "suffix apex", qname: "example.com.", wantOrdered: "example", wantLongest: "example"},
+		{name: "suffix subdomain", qname: "foo.example.com.", wantOrdered: "example", wantLongest: "example"},
+		{name: "wildcard declared after suffix", qname: "db.svc.example.com.", wantOrdered: "example", wantLongest: "svc"},
+		{name: "regex fallback", qname: "api1.test.", wantOrdered: "api", wantLongest: "api"},
+		{name: "regex fallback suffix", qname: "host.internal.", wantOrdered: "internal", wantLongest: "internal"},
+		{name: "priority over declaration", qname: "host.corp.example.", wantOrdered: "corp", wantLongest: "corp"},
+		{name: "priority tie", qname: "host.lab.corp.example.", wantOrdered: "corp", wantLongest: "lab"},
+		{name: "regex priority over suffix", qname: "www.example.org.", wantOrdered: "org-regex", wantLongest: "org-regex"},
+		{name: "no match", qname: "example.net.", wantOrdered: "", wantLongest: ""},
+	}
+
+	for _, mode := range []string{RoutingOrdered, RoutingLongestSuffix} {
+		m := setTestUpstreams(t, mode, slices.Clone(upstreams))
+
+		for _, tt := range tests {
+			t.Run(mode+"/"+tt.name, func(t *testing.T) {
+				want := tt.wantOrdered
+				if mode == RoutingLongestSuffix {
+					want = tt.wantLongest
+				}
+
+				got := ""
+				if u := m.Get(Query{Name: tt.qname}); u != nil {
+					got = u.Name
+				}
+				if got != want {
+					t.Errorf("got upstream %q, want %q", got, want)
+				}
+			})
+		}
+	}
+}
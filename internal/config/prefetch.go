@@ -0,0 +1,47 @@
+package config
+
+import "fmt"
+
+const (
+	// defaultPrefetchMinHits is the default number of hits making an entry popular.
+	defaultPrefetchMinHits = 3
+	// defaultPrefetchThreshold is the default fraction of the TTL left when popular entries are prefetched.
+	defaultPrefetchThreshold = 0.1
+)
+
+// Prefetch resolves the popular cache entries again before they expire.
+type Prefetch struct {
+	Enabled bool `yaml:"enabled"`
+	// MinHits is the number of hits since an entry was cached making it popular. Default is 3.
+	MinHits int `yaml:"minHits"`
+	// Threshold is the fraction of the TTL left when the popular entries are prefetched,
+	// between 0 and 1. Default is 0.1.
+	Threshold float64 `yaml:"threshold"`
+}
+
+// checkPrefetch returns an error if the threshold is not a fraction.
+func checkPrefetch(p Prefetch) error {
+	if p.Threshold < 0 || p.Threshold >= 1 {
+		return fmt.Errorf("prefetch: threshold must be between 0 and 1")
+	}
+
+	return nil
+}
+
+// GetMinHits returns the number of hits since an entry was cached making it popular.
+func (p *Prefetch) GetMinHits() uint64 {
+	if p.MinHits <= 0 {
+		return defaultPrefetchMinHits
+	}
+
+	return uint64(p.MinHits)
+}
+
+// GetThreshold returns the fraction of the TTL left when the popular entries are prefetched.
+func (p *Prefetch) GetThreshold() float64 {
+	if p.Threshold == 0 {
+		return defaultPrefetchThreshold
+	}
+
+	return p.Threshold
+}
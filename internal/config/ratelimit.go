@@ -0,0 +1,119 @@
+package config
+
+import (
+	"fmt"
+	"net"
+)
+
+const (
+	// defaultRateLimitIPv4Prefix and defaultRateLimitIPv6Prefix group the clients of the rate limits.
+	defaultRateLimitIPv4Prefix = 32
+	defaultRateLimitIPv6Prefix = 64
+	// defaultRRLIPv4Prefix and defaultRRLIPv6Prefix group the clients of the response rate limits.
+	defaultRRLIPv4Prefix = 24
+	defaultRRLIPv6Prefix = 56
+	// defaultRRLSlip is the default number of limited responses per truncated response.
+	defaultRRLSlip = 2
+)
+
+type (
+	// RateLimit limits the queries of each client with a token bucket.
+	RateLimit struct {
+		Enabled bool `yaml:"enabled"`
+		// QueriesPerSecond is the rate of the queries allowed per client prefix.
+		QueriesPerSecond float64 `yaml:"queriesPerSecond"`
+		// Burst is the number of queries allowed at once. Default is QueriesPerSecond.
+		Burst int `yaml:"burst"`
+		// IPv4Prefix and IPv6Prefix are the prefix lengths grouping the clients. Default is /32 and /64.
+		IPv4Prefix int `yaml:"ipv4Prefix"`
+		IPv6Prefix int `yaml:"ipv6Prefix"`
+	}
+
+	// RRL limits the identical UDP responses sent to a client prefix, to mitigate amplification attacks.
+	// The responses are identical when they have the same name and response code.
+	RRL struct {
+		Enabled bool `yaml:"enabled"`
+		// ResponsesPerSecond is the rate of the identical responses allowed per client prefix.
+		ResponsesPerSecond float64 `yaml:"responsesPerSecond"`
+		// Burst is the number of identical responses allowed at once. Default is ResponsesPerSecond.
+		Burst int `yaml:"burst"`
+		// Slip is the number of limited responses per truncated response, the others are dropped.
+		// 1 truncates all the limited responses. Default is 2, -1 drops all of them.
+		Slip int `yaml:"slip"`
+		// IPv4Prefix and IPv6Prefix are the prefix lengths grouping the clients. Default is /24 and /56.
+		IPv4Prefix int `yaml:"ipv4Prefix"`
+		IPv6Prefix int `yaml:"ipv6Prefix"`
+	}
+)
+
+// checkRateLimits returns an error if a rate limit is enabled without rate.
+func checkRateLimits(s Server) error {
+	if s.RateLimit.Enabled && s.RateLimit.QueriesPerSecond <= 0 {
+		return fmt.Errorf("rate limit: queriesPerSecond must be positive")
+	}
+
+	if s.RRL.Enabled && s.RRL.ResponsesPerSecond <= 0 {
+		return fmt.Errorf("rrl: responsesPerSecond must be positive")
+	}
+
+	return nil
+}
+
+// GetBurst returns the number of queries allowed at once.
+func (r *RateLimit) GetBurst() int {
+	if r.Burst <= 0 {
+		return max(1, int(r.QueriesPerSecond))
+	}
+
+	return r.Burst
+}
+
+// Prefix returns the client prefix the rate limit applies to.
+func (r *RateLimit) Prefix(ip net.IP) string {
+	return clientPrefix(ip, r.IPv4Prefix, defaultRateLimitIPv4Prefix, r.IPv6Prefix, defaultRateLimitIPv6Prefix)
+}
+
+// GetBurst returns the number of identical responses allowed at once.
+func (r *RRL) GetBurst() int {
+	if r.Burst <= 0 {
+		return max(1, int(r.ResponsesPerSecond))
+	}
+
+	return r.Burst
+}
+
+// GetSlip returns the number of limited responses per truncated response, 0 if none is truncated.
+func (r *RRL) GetSlip() int {
+	switch {
+	case r.Slip == 0:
+		return defaultRRLSlip
+	case r.Slip < 0:
+		return 0
+	default:
+		return r.Slip
+	}
+}
+
+// Prefix returns the client prefix the response rate limit applies to.
+func (r *RRL) Prefix(ip net.IP) string {
+	return clientPrefix(ip, r.IPv4Prefix, defaultRRLIPv4Prefix, r.IPv6Prefix, defaultRRLIPv6Prefix)
+}
+
+// clientPrefix returns the subnet of the client with the given prefix lengths.
+func clientPrefix(ip net.IP, v4, defaultV4, v6, defaultV6 int) string {
+	if ip == nil {
+		return ""
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		if v4 <= 0 || v4 > 32 {
+			v4 = defaultV4
+		}
+		return (&net.IPNet{IP: ip4.Mask(net.CIDRMask(v4, 32)), Mask: net.CIDRMask(v4, 32)}).String()
+	}
+
+	if v6 <= 0 || v6 > 128 {
+		v6 = defaultV6
+	}
+	return (&net.IPNet{IP: ip.Mask(net.CIDRMask(v6, 128)), Mask: net.CIDRMask(v6, 128)}).String()
+}
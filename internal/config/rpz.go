@@ -0,0 +1,400 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rs/zerolog/log"
+)
+
+// Triggers of the response policies.
+const (
+	TriggerQName      = "qname"
+	TriggerResponseIP = "response-ip"
+	TriggerNSDName    = "nsdname"
+)
+
+// Actions of the response policies.
+const (
+	ActionNXDomain  = "nxdomain"
+	ActionNoData    = "nodata"
+	ActionPassthru  = "passthru"
+	ActionDrop      = "drop"
+	ActionTCPOnly   = "tcp-only"
+	ActionLocalData = "local-data"
+)
+
+// defaultRPZRefresh is the default interval between two loads of the policy zones.
+const defaultRPZRefresh = time.Hour
+
+var Rpz = &RPZDB{zones: make(map[string]*policyZone)}
+
+type (
+	// RPZ configures the response policy zones.
+	RPZ struct {
+		// Refresh is the interval between two loads of the zones, in minutes. Default is 60.
+		Refresh int `yaml:"refresh"`
+		// Zones are the policy zones, the first zone matching a query wins.
+		Zones []RPZZone `yaml:"zones"`
+	}
+
+	// RPZZone is a policy zone, loaded from a file or transferred from a primary server.
+	RPZZone struct {
+		Name string `yaml:"name"`
+		File string `yaml:"file"`
+		// Primary is the address of the server the zone is transferred from with AXFR.
+		Primary string `yaml:"primary"`
+	}
+
+	// Policy is the action of a trigger of a policy zone.
+	Policy struct {
+		Zone    string
+		Trigger string
+		// Rule is the owner name of the trigger in the policy zone.
+		Rule   string
+		Action string
+		// Records are the records of the local data action, their owner is the rule.
+		Records []dns.RR
+	}
+
+	// RPZDB holds the policy zones.
+	RPZDB struct {
+		mu sync.RWMutex
+		// zones holds the zones by name, order holds them in the configuration order.
+		zones map[string]*policyZone
+		order []*policyZone
+	}
+
+	policyZone struct {
+		name     string
+		qnames   *policySet
+		nsdnames *policySet
+		// ips are sorted by prefix length, the longest prefix first.
+		ips []ipPolicy
+	}
+
+	// policySet holds the policies of names, exactly and with wildcards.
+	policySet struct {
+		names map[string]*Policy
+		// wildcards holds the policies of the subdomains, by parent name.
+		wildcards map[string]*Policy
+	}
+
+	ipPolicy struct {
+		network *net.IPNet
+		policy  *Policy
+	}
+)
+
+func newPolicySet() *policySet {
+	return &policySet{
+		names:     make(map[string]*Policy),
+		wildcards: make(map[string]*Policy),
+	}
+}
+
+// match returns the policy of the name, an exact match wins over the closest wildcard.
+func (s *policySet) match(name string) *Policy {
+	if p, ok := s.names[name]; ok {
+		return p
+	}
+
+	for off, end := dns.NextLabel(name, 0); !end; off, end = dns.NextLabel(name, off) {
+		if p, ok := s.wildcards[name[off:]]; ok {
+			return p
+		}
+	}
+
+	return s.wildcards["."]
+}
+
+// add adds the policy of the name, a leading *. label makes it a wildcard.
+func (s *policySet) add(name string, p *Policy) {
+	if parent, ok := strings.CutPrefix(name, "*."); ok {
+		if parent == "" {
+			parent = "."
+		}
+		s.wildcards[parent] = p
+		return
+	}
+
+	s.names[name] = p
+}
+
+// GetRefresh returns the interval between two loads of the policy zones.
+func (r *RPZ) GetRefresh() time.Duration {
+	if r.Refresh <= 0 {
+		return defaultRPZRefresh
+	}
+
+	return time.Duration(r.Refresh) * time.Minute
+}
+
+// checkRPZ returns an error if a policy zone has no source.
+func checkRPZ(r RPZ) error {
+	for _, z := range r.Zones {
+		if z.Name == "" || (z.File == "") == (z.Primary == "") {
+			return fmt.Errorf("rpz zone %q: a name and either a file or a primary are required", z.Name)
+		}
+	}
+
+	return nil
+}
+
+// LoadRPZ loads the policy zones of the configuration.
+// The zones that can not be loaded keep the policies of the last successful load.
+func LoadRPZ() {
+	zones := Get().RPZ.Zones
+
+	order := make([]*policyZone, 0, len(zones))
+	for _, z := range zones {
+		name := strings.ToLower(dns.Fqdn(z.Name))
+
+		pz, err := loadPolicyZone(z, name)
+		if err != nil {
+			log.Error().Err(err).Msgf("Error loading policy zone %s", name)
+
+			Rpz.mu.RLock()
+			pz = Rpz.zones[name]
+			Rpz.mu.RUnlock()
+			if pz == nil {
+				continue
+			}
+		}
+
+		order = append(order, pz)
+	}
+
+	Rpz.mu.Lock()
+	defer Rpz.mu.Unlock()
+
+	Rpz.order = order
+	Rpz.zones = make(map[string]*policyZone, len(order))
+	for _, pz := range order {
+		Rpz.zones[pz.name] = pz
+	}
+}
+
+// loadPolicyZone reads the records of the zone and parses its triggers.
+func loadPolicyZone(z RPZZone, name string) (*policyZone, error) {
+	var (
+		rrs []dns.RR
+		err error
+	)
+
+	if z.File != "" {
+		f, err := os.Open(z.File)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		rrs, err = parseRecords(f, name, z.File)
+		if err != nil {
+			return nil, err
+		}
+	} else if rrs, err = transferZone(name, z.Primary); err != nil {
+		return nil, err
+	}
+
+	// The records of an owner make a single policy
+	owners := make(map[string][]dns.RR)
+	var names []string
+	for _, rr := range rrs {
+		owner := strings.ToLower(rr.Header().Name)
+		if !dns.IsSubDomain(name, owner) || owner == name {
+			continue
+		}
+		if _, ok := owners[owner]; !ok {
+			names = append(names, owner)
+		}
+		owners[owner] = append(owners[owner], rr)
+	}
+
+	pz := &policyZone{
+		name:     name,
+		qnames:   newPolicySet(),
+		nsdnames: newPolicySet(),
+	}
+
+	for _, owner := range names {
+		rule := strings.TrimSuffix(owner, name)
+		p := &Policy{Zone: name, Rule: owner, Action: policyAction(owners[owner]), Records: owners[owner]}
+
+		switch {
+		case strings.HasSuffix(rule, ".rpz-ip."):
+			network, err := parseRPZIP(strings.TrimSuffix(rule, ".rpz-ip."))
+			if err != nil {
+				log.Warn().Err(err).Msgf("Ignoring policy %s", owner)
+				continue
+			}
+			p.Trigger = TriggerResponseIP
+			pz.ips = append(pz.ips, ipPolicy{network: network, policy: p})
+		case strings.HasSuffix(rule, ".rpz-nsdname."):
+			p.Trigger = TriggerNSDName
+			pz.nsdnames.add(strings.TrimSuffix(rule, "rpz-nsdname."), p)
+		case strings.HasSuffix(rule, ".rpz-client-ip."), strings.HasSuffix(rule, ".rpz-nsip."):
+			log.Debug().Msgf("Ignoring unsupported policy %s", owner)
+		default:
+			p.Trigger = TriggerQName
+			pz.qnames.add(rule, p)
+		}
+	}
+
+	slices.SortStableFunc(pz.ips, func(a, b ipPolicy) int {
+		la, _ := a.network.Mask.Size()
+		lb, _ := b.network.Mask.Size()
+		return lb - la
+	})
+
+	log.Info().Msgf("Loaded policy zone %s (%d qname, %d response-ip, %d nsdname)", name,
+		len(pz.qnames.names)+len(pz.qnames.wildcards), len(pz.ips), len(pz.nsdnames.names)+len(pz.nsdnames.wildcards))
+
+	return pz, nil
+}
+
+// transferZone transfers the zone from the primary server with AXFR.
+func transferZone(name, primary string) ([]dns.RR, error) {
+	if _, _, err := net.SplitHostPort(primary); err != nil {
+		primary = net.JoinHostPort(primary, "53")
+	}
+
+	m := new(dns.Msg)
+	m.SetAxfr(name)
+
+	envelopes, err := new(dns.Transfer).In(m, primary)
+	if err != nil {
+		return nil, err
+	}
+
+	var rrs []dns.RR
+	for e := range envelopes {
+		if e.Error != nil {
+			return nil, e.Error
+		}
+		rrs = append(rrs, e.RR...)
+	}
+
+	return rrs, nil
+}
+
+// policyAction returns the action encoded by the records of a trigger.
+func policyAction(rrs []dns.RR) string {
+	if len(rrs) != 1 {
+		return ActionLocalData
+	}
+
+	cname, ok := rrs[0].(*dns.CNAME)
+	if !ok {
+		return ActionLocalData
+	}
+
+	switch strings.ToLower(cname.Target) {
+	case ".":
+		return ActionNXDomain
+	case "*.":
+		return ActionNoData
+	case "rpz-passthru.":
+		return ActionPassthru
+	case "rpz-drop.":
+		return ActionDrop
+	case "rpz-tcp-only.":
+		return ActionTCPOnly
+	default:
+		return ActionLocalData
+	}
+}
+
+// parseRPZIP parses the subnet of a response IP trigger, e.g. 24.0.2.0.192 for 192.0.2.0/24
+// or 48.zz.db8.2001 for 2001:db8::/48.
+func parseRPZIP(rule string) (*net.IPNet, error) {
+	labels := strings.Split(rule, ".")
+	if len(labels) < 2 {
+		return nil, fmt.Errorf("invalid response ip trigger %q", rule)
+	}
+
+	prefix, err := strconv.Atoi(labels[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid prefix in response ip trigger %q", rule)
+	}
+
+	addr := labels[1:]
+	slices.Reverse(addr)
+
+	var cidr string
+	if len(addr) == 4 && !slices.Contains(addr, "zz") {
+		cidr = strings.Join(addr, ".")
+	} else {
+		cidr = strings.Join(addr, ":")
+		switch {
+		case strings.HasPrefix(cidr, "zz"):
+			cidr = ":" + strings.TrimPrefix(cidr, "zz")
+		case strings.HasSuffix(cidr, "zz"):
+			cidr = strings.TrimSuffix(cidr, "zz") + ":"
+		default:
+			cidr = strings.Replace(cidr, "zz", "", 1)
+		}
+	}
+
+	_, network, err := net.ParseCIDR(cidr + "/" + strconv.Itoa(prefix))
+	return network, err
+}
+
+// MatchQName returns the policy of the query name, or nil if no zone matches it.
+func (r *RPZDB) MatchQName(name string) *Policy {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	name = strings.ToLower(dns.Fqdn(name))
+	for _, z := range r.order {
+		if p := z.qnames.match(name); p != nil {
+			return p
+		}
+	}
+
+	return nil
+}
+
+// MatchResponse returns the policy of the addresses of the answer or of the name servers of the name,
+// or nil if no zone matches them. The name servers are only looked up by zones with nsdname triggers.
+func (r *RPZDB) MatchResponse(ips []net.IP, nameServers func() []string) *Policy {
+	// The lock is not held while the name servers are resolved, the loaded zones are never modified
+	r.mu.RLock()
+	order := slices.Clone(r.order)
+	r.mu.RUnlock()
+
+	var (
+		ns       []string
+		resolved bool
+	)
+
+	for _, z := range order {
+		for _, ipp := range z.ips {
+			if slices.ContainsFunc(ips, ipp.network.Contains) {
+				return ipp.policy
+			}
+		}
+
+		if len(z.nsdnames.names) == 0 && len(z.nsdnames.wildcards) == 0 {
+			continue
+		}
+
+		if !resolved {
+			ns, resolved = nameServers(), true
+		}
+		for _, n := range ns {
+			if p := z.nsdnames.match(strings.ToLower(dns.Fqdn(n))); p != nil {
+				return p
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,126 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseRPZIP(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    string
+		want    string
+		wantErr bool
+	}{
+		{name: "ipv4 network", rule: "24.0.2.0.192", want: "192.0.2.0/24"},
+		{name: "ipv4 host", rule: "32.1.2.0.192", want: "192.0.2.1/32"},
+		{name: "ipv4 host bits masked", rule: "8.1.2.0.10", want: "10.0.0.0/8"},
+		{name: "ipv6 zz in the middle", rule: "128.1.zz.db8.2001", want: "2001:db8::1/128"},
+		{name: "ipv6 zz at the end", rule: "48.zz.db8.2001", want: "2001:db8::/48"},
+		{name: "ipv6 zz at the start", rule: "128.1.zz", want: "::1/128"},
+		{name: "ipv6 full", rule: "64.0.0.0.0.0.0.db8.2001", want: "2001:db8::/64"},
+		{name: "no address", rule: "24", wantErr: true},
+		{name: "invalid prefix", rule: "x.1.2.0.192", wantErr: true},
+		{name: "prefix too long", rule: "33.1.2.0.192", wantErr: true},
+		{name: "invalid address", rule: "24.0.2.0.300", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			network, err := parseRPZIP(tt.rule)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("got network %s, want error", network)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if network.String() != tt.want {
+				t.Errorf("got network %s, want %s", network, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadPolicyZone(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "rpz.zone")
+	zone := `$TTL 300
+@ IN SOA localhost. hostmaster.localhost. 1 3600 600 86400 60
+@ IN NS localhost.
+nxdomain IN CNAME .
+nodata IN CNAME *.
+passthru IN CNAME rpz-passthru.
+drop IN CNAME rpz-drop.
+tcp IN CNAME rpz-tcp-only.
+*.wildcard IN CNAME .
+alias IN CNAME www.example.com.
+data IN A 192.0.2.1
+data IN AAAA 2001:db8::1
+24.0.2.0.192.rpz-ip IN CNAME .
+bad.rpz-ip IN CNAME .
+ns.example.com.rpz-nsdname IN CNAME rpz-drop.
+`
+	if err := os.WriteFile(file, []byte(zone), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	pz, err := loadPolicyZone(RPZZone{Name: "rpz.test", File: file}, "rpz.test.")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		qname       string
+		wantAction  string
+		wantRecords int
+	}{
+		{name: "nxdomain", qname: "nxdomain.", wantAction: ActionNXDomain, wantRecords: 1},
+		{name: "nodata", qname: "nodata.", wantAction: ActionNoData, wantRecords: 1},
+		{name: "passthru", qname: "passthru.", wantAction: ActionPassthru, wantRecords: 1},
+		{name: "drop", qname: "drop.", wantAction: ActionDrop, wantRecords: 1},
+		{name: "tcp only", qname: "tcp.", wantAction: ActionTCPOnly, wantRecords: 1},
+		{name: "wildcard", qname: "host.wildcard.", wantAction: ActionNXDomain, wantRecords: 1},
+		{name: "wildcard apex", qname: "wildcard."},
+		{name: "cname local data", qname: "alias.", wantAction: ActionLocalData, wantRecords: 1},
+		{name: "address local data", qname: "data.", wantAction: ActionLocalData, wantRecords: 2},
+		{name: "no match", qname: "other."},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := pz.qnames.match(tt.qname)
+			if tt.wantAction == "" {
+				if p != nil {
+					t.Errorf("got policy %s, want none", p.Rule)
+				}
+				return
+			}
+			if p == nil {
+				t.Fatal("got no policy")
+			}
+
+			if p.Trigger != TriggerQName {
+				t.Errorf("got trigger %s, want %s", p.Trigger, TriggerQName)
+			}
+			if p.Action != tt.wantAction {
+				t.Errorf("got action %s, want %s", p.Action, tt.wantAction)
+			}
+			if len(p.Records) != tt.wantRecords {
+				t.Errorf("got %d records, want %d", len(p.Records), tt.wantRecords)
+			}
+		})
+	}
+
+	// The invalid response ip trigger is ignored
+	if len(pz.ips) != 1 || pz.ips[0].network.String() != "192.0.2.0/24" {
+		t.Errorf("got response ip triggers %v, want 192.0.2.0/24", pz.ips)
+	}
+	if p := pz.nsdnames.match("ns.example.com."); p == nil || p.Action != ActionDrop || p.Trigger != TriggerNSDName {
+		t.Errorf("got nsdname policy %v, want %s", p, ActionDrop)
+	}
+}
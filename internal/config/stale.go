@@ -0,0 +1,54 @@
+package config
+
+import "time"
+
+const (
+	// defaultStaleWindow is the default duration expired entries are kept to be served stale.
+	defaultStaleWindow = 24 * time.Hour
+	// defaultStaleTTL is the default TTL of the stale answers (RFC 8767 section 4).
+	defaultStaleTTL = 30
+	// defaultStaleClientTimeout is the default time waited for the upstreams before answering stale data.
+	defaultStaleClientTimeout = 1800 * time.Millisecond
+)
+
+// ServeStale answers from the expired cache entries when the upstreams fail or are slow (RFC 8767).
+type ServeStale struct {
+	Enabled bool `yaml:"enabled"`
+	// Window is the duration expired entries are kept and served, in seconds. Default is one day.
+	Window int `yaml:"window"`
+	// TTL is the TTL of the stale answers, in seconds. Default is 30.
+	TTL int `yaml:"ttl"`
+	// ClientTimeout is the time waited for the upstreams before answering stale data, in milliseconds.
+	// The resolution goes on in the background to refresh the entry. Default is 1800.
+	ClientTimeout int `yaml:"clientTimeout"`
+}
+
+// GetWindow returns the duration expired entries are kept and served, zero when serve-stale is disabled.
+func (s *ServeStale) GetWindow() time.Duration {
+	switch {
+	case !s.Enabled:
+		return 0
+	case s.Window <= 0:
+		return defaultStaleWindow
+	default:
+		return time.Duration(s.Window) * time.Second
+	}
+}
+
+// GetTTL returns the TTL of the stale answers.
+func (s *ServeStale) GetTTL() uint32 {
+	if s.TTL <= 0 {
+		return defaultStaleTTL
+	}
+
+	return uint32(s.TTL)
+}
+
+// GetClientTimeout returns the time waited for the upstreams before answering stale data.
+func (s *ServeStale) GetClientTimeout() time.Duration {
+	if s.ClientTimeout <= 0 {
+		return defaultStaleClientTimeout
+	}
+
+	return time.Duration(s.ClientTimeout) * time.Millisecond
+}
@@ -0,0 +1,119 @@
+package config
+
+import (
+	"path"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Kinds of routing rules.
+const (
+	MatchRegex    = "regex"
+	MatchDomain   = "domain"
+	MatchSuffix   = "suffix"
+	MatchWildcard = "wildcard"
+)
+
+type (
+	// domainTrie indexes the domain, suffix and wildcard rules by their labels, from the root.
+	// A lookup costs O(labels) instead of O(rules).
+	domainTrie struct {
+		root *trieNode
+	}
+
+	trieNode struct {
+		children map[string]*trieNode
+		// globs are the children whose label is a glob pattern.
+		globs []trieGlob
+		// names are the rules matching the names ending at this node.
+		names []int
+		// suffixes are the rules matching the names ending at this node and their subdomains.
+		suffixes []int
+	}
+
+	trieGlob struct {
+		pattern string
+		node    *trieNode
+	}
+)
+
+func newDomainTrie() *domainTrie {
+	return &domainTrie{root: &trieNode{}}
+}
+
+// reversedLabels returns the labels of the name, from the root.
+func reversedLabels(name string) []string {
+	labels := dns.SplitDomainName(name)
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+
+	return labels
+}
+
+// insert adds the rule of the given kind for the name, the name is lower case and fully qualified.
+func (t *domainTrie) insert(name, kind string, rule int) {
+	n := t.root
+	for _, label := range reversedLabels(name) {
+		n = n.child(label, kind == MatchWildcard && strings.ContainsAny(label, "*?["))
+	}
+
+	if kind == MatchSuffix {
+		n.suffixes = append(n.suffixes, rule)
+	} else {
+		n.names = append(n.names, rule)
+	}
+}
+
+// child returns the child of the node for the label, it is created if it does not exist.
+func (n *trieNode) child(label string, glob bool) *trieNode {
+	if glob {
+		for _, g := range n.globs {
+			if g.pattern == label {
+				return g.node
+			}
+		}
+		c := &trieNode{}
+		n.globs = append(n.globs, trieGlob{pattern: label, node: c})
+		return c
+	}
+
+	if n.children == nil {
+		n.children = make(map[string]*trieNode)
+	}
+	c, ok := n.children[label]
+	if !ok {
+		c = &trieNode{}
+		n.children[label] = c
+	}
+
+	return c
+}
+
+// lookup calls fn with each rule matching the name and the number of labels it matches.
+func (t *domainTrie) lookup(name string, fn func(rule, labels int)) {
+	t.root.lookup(reversedLabels(strings.ToLower(name)), 0, fn)
+}
+
+func (n *trieNode) lookup(labels []string, depth int, fn func(rule, labels int)) {
+	for _, r := range n.suffixes {
+		fn(r, depth)
+	}
+
+	if depth == len(labels) {
+		for _, r := range n.names {
+			fn(r, depth)
+		}
+		return
+	}
+
+	if c, ok := n.children[labels[depth]]; ok {
+		c.lookup(labels, depth+1, fn)
+	}
+	for _, g := range n.globs {
+		if ok, _ := path.Match(g.pattern, labels[depth]); ok {
+			g.node.lookup(labels, depth+1, fn)
+		}
+	}
+}
@@ -0,0 +1,376 @@
+package config
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// maxCNAMEChain is the maximum number of CNAME records followed in the local data.
+const maxCNAMEChain = 8
+
+var Lz = &LocalZones{}
+
+type (
+	// Zone is a local zone answered authoritatively, from a zone file and/or records.
+	Zone struct {
+		Name string `yaml:"name"`
+		// File is an RFC 1035 zone file, the relative names are relative to the zone.
+		File string `yaml:"file"`
+		// Records are records in zone file format, e.g. "printer 300 IN A 192.168.1.10".
+		Records []string `yaml:"records"`
+	}
+
+	// LocalZones holds the local zones and the static records of the configuration.
+	LocalZones struct {
+		mu      sync.RWMutex
+		zones   map[string]*localZone
+		records map[string][]dns.RR
+	}
+
+	localZone struct {
+		name string
+		soa  *dns.SOA
+		// names holds the records of each name of the zone.
+		// The empty non-terminals are present without records.
+		names map[string][]dns.RR
+	}
+
+	// LocalAnswer is the answer to a query from the local data.
+	LocalAnswer struct {
+		Rcode  int
+		Answer []dns.RR
+		Ns     []dns.RR
+		// Target is the name the CNAME chain of the answer leads to outside the local data,
+		// resolved by the upstreams. It is empty when the chain ends in the local data.
+		Target string
+		// Authoritative is true when the name belongs to a local zone, and is not delegated.
+		Authoritative bool
+	}
+)
+
+// Compute parses the local zones and the static records.
+// The static records of a name inside a local zone are added to the zone.
+func (l *LocalZones) Compute(zones []Zone, records []string) error {
+	next, err := compileLocalZones(zones, records)
+	if err != nil {
+		return err
+	}
+
+	l.set(next)
+
+	return nil
+}
+
+// compileLocalZones parses the local zones and the static records in new local data.
+func compileLocalZones(zones []Zone, records []string) (*LocalZones, error) {
+	compiled := make(map[string]*localZone, len(zones))
+	for _, z := range zones {
+		lz, err := compileZone(z)
+		if err != nil {
+			return nil, fmt.Errorf("zone %s: %w", z.Name, err)
+		}
+		compiled[lz.name] = lz
+	}
+
+	static := make(map[string][]dns.RR)
+	rrs, err := parseRecords(strings.NewReader(strings.Join(records, "\n")), ".", "")
+	if err != nil {
+		return nil, fmt.Errorf("records: %w", err)
+	}
+	for _, rr := range rrs {
+		if z := findZone(compiled, rr.Header().Name); z != nil {
+			z.add(rr)
+			continue
+		}
+		static[rr.Header().Name] = append(static[rr.Header().Name], rr)
+	}
+
+	return &LocalZones{zones: compiled, records: static}, nil
+}
+
+// set replaces the local data with the data of next.
+func (l *LocalZones) set(next *LocalZones) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.zones = next.zones
+	l.records = next.records
+}
+
+// compileZone parses the file and the records of the zone.
+// A default SOA record is created when the zone has none.
+func compileZone(z Zone) (*localZone, error) {
+	lz := &localZone{
+		name:  strings.ToLower(dns.Fqdn(z.Name)),
+		names: make(map[string][]dns.RR),
+	}
+
+	var rrs []dns.RR
+	if z.File != "" {
+		f, err := os.Open(z.File)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		if rrs, err = parseRecords(f, lz.name, z.File); err != nil {
+			return nil, err
+		}
+	}
+
+	records, err := parseRecords(strings.NewReader(strings.Join(z.Records, "\n")), lz.name, "")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, rr := range append(rrs, records...) {
+		if !dns.IsSubDomain(lz.name, rr.Header().Name) {
+			return nil, fmt.Errorf("record %s is out of the zone", rr.Header().Name)
+		}
+		lz.add(rr)
+	}
+
+	if lz.soa == nil {
+		lz.soa = &dns.SOA{
+			Hdr:     dns.RR_Header{Name: lz.name, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 3600},
+			Ns:      "localhost.",
+			Mbox:    "hostmaster." + lz.name,
+			Serial:  1,
+			Refresh: 3600,
+			Retry:   600,
+			Expire:  86400,
+			Minttl:  60,
+		}
+		lz.add(lz.soa)
+	}
+
+	return lz, nil
+}
+
+// parseRecords parses records in zone file format.
+func parseRecords(r io.Reader, origin, file string) ([]dns.RR, error) {
+	zp := dns.NewZoneParser(r, origin, file)
+	// Zone files may include other files
+	zp.SetIncludeAllowed(file != "")
+
+	var rrs []dns.RR
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		rr.Header().Name = strings.ToLower(rr.Header().Name)
+		rrs = append(rrs, rr)
+	}
+
+	return rrs, zp.Err()
+}
+
+// add adds the record to the zone, the names between the record and the apex exist without records.
+func (z *localZone) add(rr dns.RR) {
+	name := rr.Header().Name
+	z.names[name] = append(z.names[name], rr)
+
+	if soa, ok := rr.(*dns.SOA); ok && name == z.name {
+		z.soa = soa
+	}
+
+	for off, end := dns.NextLabel(name, 0); !end && name[off:] != z.name; off, end = dns.NextLabel(name, off) {
+		if _, ok := z.names[name[off:]]; !ok {
+			z.names[name[off:]] = []dns.RR{}
+		}
+	}
+}
+
+// negativeSOA returns the SOA record of the negative answers of the zone.
+// Its TTL is the minimum of the SOA TTL and the SOA MINIMUM field (RFC 2308).
+func (z *localZone) negativeSOA() []dns.RR {
+	soa := dns.Copy(z.soa).(*dns.SOA)
+	soa.Hdr.Ttl = min(soa.Hdr.Ttl, soa.Minttl)
+
+	return []dns.RR{soa}
+}
+
+// findZone returns the closest zone of the name, or nil if the name is not in a zone.
+func findZone(zones map[string]*localZone, name string) *localZone {
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if z, ok := zones[name[off:]]; ok {
+			return z
+		}
+	}
+
+	return zones["."]
+}
+
+// Lookup answers the query from the local data.
+// It returns false if the name is neither in a local zone nor a static record, or if it is delegated.
+func (l *LocalZones) Lookup(name string, qtype uint16) (LocalAnswer, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	var answer LocalAnswer
+	name = strings.ToLower(dns.Fqdn(name))
+
+	for i := 0; i < maxCNAMEChain; i++ {
+		rrs, z, found := l.find(name)
+		if !found {
+			// The target of the CNAME is not local, it is resolved by the upstreams
+			if i > 0 {
+				answer.Target = name
+			}
+			return answer, i > 0
+		}
+
+		// The names at or below a zone cut are resolved by the name servers of the cut, see Delegation
+		if cut := z.delegation(name, qtype); cut != nil {
+			if i > 0 {
+				// The target of the CNAME is delegated, it is resolved by the upstreams
+				answer.Target = name
+			}
+			return answer, i > 0
+		}
+
+		if i == 0 {
+			answer.Authoritative = z != nil
+		}
+
+		if rrs == nil {
+			answer.Rcode = dns.RcodeNameError
+			answer.Ns = z.negativeSOA()
+			return answer, true
+		}
+
+		if matched := filterType(rrs, qtype); len(matched) > 0 {
+			answer.Answer = append(answer.Answer, matched...)
+			return answer, true
+		}
+
+		if cname := filterType(rrs, dns.TypeCNAME); len(cname) > 0 {
+			answer.Answer = append(answer.Answer, cname[0])
+			name = strings.ToLower(cname[0].(*dns.CNAME).Target)
+			continue
+		}
+
+		// The name exists without records of the type
+		if z != nil {
+			answer.Ns = z.negativeSOA()
+		}
+		return answer, true
+	}
+
+	return answer, true
+}
+
+// Delegation returns the NS records of the zone cut of a name delegated by a local zone,
+// and the address records of the name servers inside the zone.
+// It returns nil if the name is not delegated.
+func (l *LocalZones) Delegation(name string, qtype uint16) (ns, glue []dns.RR) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	name = strings.ToLower(dns.Fqdn(name))
+	z := findZone(l.zones, name)
+	if ns = z.delegation(name, qtype); ns == nil {
+		return nil, nil
+	}
+
+	return ns, z.glue(ns)
+}
+
+// find returns the records of the name and its zone.
+// The records of a name of a zone that does not exist are synthesized from the matching wildcard,
+// they are nil if there is none.
+func (l *LocalZones) find(name string) ([]dns.RR, *localZone, bool) {
+	if z := findZone(l.zones, name); z != nil {
+		if rrs, ok := z.names[name]; ok {
+			return rrs, z, true
+		}
+		return z.wildcard(name), z, true
+	}
+
+	rrs, ok := l.records[name]
+	return rrs, nil, ok
+}
+
+// wildcard returns the records of the wildcard matching the name that does not exist, owned by the name.
+// The wildcard is the * child of the closest encloser, the closest ancestor of the name that exists (RFC 4592 section 3.3.1).
+func (z *localZone) wildcard(name string) []dns.RR {
+	for off, end := dns.NextLabel(name, 0); !end; off, end = dns.NextLabel(name, off) {
+		encloser := name[off:]
+		if _, ok := z.names[encloser]; !ok {
+			continue
+		}
+
+		source := "*." + encloser
+		if encloser == "." {
+			source = "*."
+		}
+
+		rrs := z.names[source]
+		if len(rrs) == 0 {
+			return nil
+		}
+
+		synthesized := make([]dns.RR, len(rrs))
+		for i, rr := range rrs {
+			synthesized[i] = dns.Copy(rr)
+			synthesized[i].Header().Name = name
+		}
+
+		return synthesized
+	}
+
+	return nil
+}
+
+// delegation returns the NS records of the highest zone cut at or above the name, or nil if the name is not delegated.
+// The zone answers the DS records of the cut itself, they belong to the parent side (RFC 4035 section 3.1.4.1).
+func (z *localZone) delegation(name string, qtype uint16) []dns.RR {
+	if z == nil {
+		return nil
+	}
+
+	var cut []dns.RR
+	for off, end := 0, false; !end && name[off:] != z.name; off, end = dns.NextLabel(name, off) {
+		if off == 0 && qtype == dns.TypeDS {
+			continue
+		}
+		if ns := filterType(z.names[name[off:]], dns.TypeNS); len(ns) > 0 {
+			cut = ns
+		}
+	}
+
+	return cut
+}
+
+// glue returns the address records of the name servers inside the zone.
+func (z *localZone) glue(ns []dns.RR) []dns.RR {
+	var extra []dns.RR
+	for _, rr := range ns {
+		target := strings.ToLower(rr.(*dns.NS).Ns)
+		if !dns.IsSubDomain(z.name, target) {
+			continue
+		}
+		extra = append(extra, filterType(z.names[target], dns.TypeA)...)
+		extra = append(extra, filterType(z.names[target], dns.TypeAAAA)...)
+	}
+
+	return extra
+}
+
+// filterType returns the records of the type, all of them for ANY queries.
+func filterType(rrs []dns.RR, qtype uint16) []dns.RR {
+	if qtype == dns.TypeANY {
+		return rrs
+	}
+
+	var matched []dns.RR
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == qtype {
+			matched = append(matched, rr)
+		}
+	}
+
+	return matched
+}
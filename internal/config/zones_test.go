@@ -0,0 +1,126 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// testLocalZones returns the local zone lan. with wildcards and a delegation.
+func testLocalZones(t *testing.T) *LocalZones {
+	t.Helper()
+
+	l := &LocalZones{}
+	if err := l.Compute([]Zone{{
+		Name: "lan.",
+		Records: []string{
+			"host 300 IN A 192.168.1.10",
+			"*.apps 300 IN A 192.168.1.20",
+			"*.apps 300 IN TXT \"wildcard\"",
+			"exists.apps 300 IN TXT \"exists\"",
+			"alias 300 IN CNAME host.apps",
+			"external 300 IN CNAME www.example.com.",
+			"delegated 300 IN CNAME www.sub",
+			"sub 300 IN NS ns1.sub",
+			"sub 300 IN DS 1 8 2 AABBCCDD",
+			"ns1.sub 300 IN A 192.168.1.53",
+		},
+	}}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	return l
+}
+
+func TestLocalZonesLookup(t *testing.T) {
+	l := testLocalZones(t)
+
+	tests := []struct {
+		name          string
+		qname         string
+		qtype         uint16
+		wantRcode     int
+		wantAnswer    int
+		wantNs        uint16
+		wantTarget    string
+		authoritative bool
+	}{
+		{name: "exact", qname: "host.lan.", qtype: dns.TypeA, wantAnswer: 1, authoritative: true},
+		{name: "wildcard", qname: "foo.apps.lan.", qtype: dns.TypeA, wantAnswer: 1, authoritative: true},
+		{name: "wildcard deep", qname: "a.b.apps.lan.", qtype: dns.TypeTXT, wantAnswer: 1, authoritative: true},
+		{name: "wildcard nodata", qname: "foo.apps.lan.", qtype: dns.TypeAAAA, wantNs: dns.TypeSOA, authoritative: true},
+		{name: "existing name blocks wildcard", qname: "exists.apps.lan.", qtype: dns.TypeA, wantNs: dns.TypeSOA, authoritative: true},
+		{name: "below existing name", qname: "foo.exists.apps.lan.", qtype: dns.TypeA, wantRcode: dns.RcodeNameError, wantNs: dns.TypeSOA, authoritative: true},
+		{name: "cname to wildcard", qname: "alias.lan.", qtype: dns.TypeA, wantAnswer: 2, authoritative: true},
+		{name: "cname out of zone", qname: "external.lan.", qtype: dns.TypeA, wantAnswer: 1, wantTarget: "www.example.com.", authoritative: true},
+		{name: "cname to delegation", qname: "delegated.lan.", qtype: dns.TypeA, wantAnswer: 1, wantTarget: "www.sub.lan.", authoritative: true},
+		{name: "no wildcard", qname: "foo.lan.", qtype: dns.TypeA, wantRcode: dns.RcodeNameError, wantNs: dns.TypeSOA, authoritative: true},
+		{name: "ds at cut", qname: "sub.lan.", qtype: dns.TypeDS, wantAnswer: 1, authoritative: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			answer, ok := l.Lookup(tt.qname, tt.qtype)
+			if !ok {
+				t.Fatal("got no local answer")
+			}
+
+			if answer.Rcode != tt.wantRcode {
+				t.Errorf("got rcode %s, want %s", dns.RcodeToString[answer.Rcode], dns.RcodeToString[tt.wantRcode])
+			}
+			if len(answer.Answer) != tt.wantAnswer {
+				t.Errorf("got %d answers, want %d: %v", len(answer.Answer), tt.wantAnswer, answer.Answer)
+			}
+			for _, rr := range answer.Answer {
+				if rr.Header().Name == "*.apps.lan." {
+					t.Errorf("got wildcard owner in answer %v", rr)
+				}
+			}
+			if tt.wantNs != 0 && (len(answer.Ns) == 0 || answer.Ns[0].Header().Rrtype != tt.wantNs) {
+				t.Errorf("got authority %v, want %s", answer.Ns, dns.TypeToString[tt.wantNs])
+			}
+			if answer.Target != tt.wantTarget {
+				t.Errorf("got target %q, want %q", answer.Target, tt.wantTarget)
+			}
+			if answer.Authoritative != tt.authoritative {
+				t.Errorf("got authoritative %t, want %t", answer.Authoritative, tt.authoritative)
+			}
+		})
+	}
+}
+
+func TestLocalZonesDelegation(t *testing.T) {
+	l := testLocalZones(t)
+
+	tests := []struct {
+		name      string
+		qname     string
+		qtype     uint16
+		wantNs    int
+		wantGlue  int
+		wantLocal bool
+	}{
+		{name: "below cut", qname: "www.sub.lan.", qtype: dns.TypeA, wantNs: 1, wantGlue: 1},
+		{name: "at cut", qname: "sub.lan.", qtype: dns.TypeA, wantNs: 1, wantGlue: 1},
+		{name: "ds at cut", qname: "sub.lan.", qtype: dns.TypeDS, wantLocal: true},
+		{name: "not delegated", qname: "host.lan.", qtype: dns.TypeA, wantLocal: true},
+		{name: "out of zone", qname: "www.example.com.", qtype: dns.TypeA},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ns, glue := l.Delegation(tt.qname, tt.qtype)
+			if len(ns) != tt.wantNs {
+				t.Errorf("got name servers %v, want %d", ns, tt.wantNs)
+			}
+			if len(glue) != tt.wantGlue {
+				t.Errorf("got glue %v, want %d", glue, tt.wantGlue)
+			}
+
+			// The delegated names are not answered from the local data
+			if _, ok := l.Lookup(tt.qname, tt.qtype); ok != tt.wantLocal {
+				t.Errorf("got local answer %t, want %t", ok, tt.wantLocal)
+			}
+		})
+	}
+}
@@ -0,0 +1,209 @@
+// Metrics is a package that holds the Prometheus metrics of the application.
+
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "dnsr"
+
+var (
+	// Queries counts the queries answered, by type and response code.
+	Queries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "queries_total",
+		Help:      "Number of DNS queries answered, by type and response code.",
+	}, []string{"qtype", "rcode"})
+
+	// DeniedQueries counts the queries of the clients denied by the access control lists, by action.
+	DeniedQueries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "denied_queries_total",
+		Help:      "Number of DNS queries of denied clients, by action.",
+	}, []string{"action"})
+
+	// RateLimited counts the queries dropped or truncated by the rate limits, by limit and action.
+	RateLimited = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rate_limited_total",
+		Help:      "Number of DNS queries dropped or truncated by the rate limits, by limit and action.",
+	}, []string{"limit", "action"})
+
+	// CacheHits counts the queries answered from the cache.
+	CacheHits = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "cache",
+		Name:      "hits_total",
+		Help:      "Number of DNS queries answered from the cache.",
+	})
+
+	// CacheMisses counts the queries not found in the cache.
+	CacheMisses = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "cache",
+		Name:      "misses_total",
+		Help:      "Number of DNS queries not found in the cache.",
+	})
+
+	// CacheDeletions counts the entries deleted from the cache with the clear commands and the admin API.
+	CacheDeletions = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "cache",
+		Name:      "deletions_total",
+		Help:      "Number of entries deleted from the cache with the clear commands and the admin API.",
+	})
+
+	// CacheStale counts the queries answered from an expired cache entry.
+	CacheStale = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "cache",
+		Name:      "stale_answers_total",
+		Help:      "Number of DNS queries answered from an expired cache entry.",
+	})
+
+	// CachePrefetches counts the popular entries resolved again before they expire, by result.
+	CachePrefetches = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "cache",
+		Name:      "prefetches_total",
+		Help:      "Number of popular cache entries resolved again before they expire, by result.",
+	}, []string{"result"})
+
+	// CacheExpired counts the expired entries deleted from the cache.
+	CacheExpired = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "cache",
+		Name:      "expired_total",
+		Help:      "Number of expired entries deleted from the cache.",
+	})
+
+	// UpstreamRequests counts the requests sent to the upstream servers.
+	UpstreamRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "upstream",
+		Name:      "requests_total",
+		Help:      "Number of requests sent to the upstream servers.",
+	}, []string{"server"})
+
+	// UpstreamErrors counts the requests to the upstream servers which failed or returned SERVFAIL.
+	UpstreamErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "upstream",
+		Name:      "errors_total",
+		Help:      "Number of requests to the upstream servers which failed or returned SERVFAIL.",
+	}, []string{"server"})
+
+	// UpstreamDuration observes the duration of the requests to the upstream servers.
+	UpstreamDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "upstream",
+		Name:      "request_duration_seconds",
+		Help:      "Duration of the requests to the upstream servers.",
+		Buckets:   []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+	}, []string{"server"})
+
+	// UpstreamHealthy is 1 when the upstream server is healthy, 0 otherwise.
+	UpstreamHealthy = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "upstream",
+		Name:      "healthy",
+		Help:      "Whether the upstream server is healthy (1) or not (0).",
+	}, []string{"server"})
+
+	// ExternalUpstreamsFetches counts the fetches of the external upstreams, by URL and result.
+	ExternalUpstreamsFetches = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "external_upstreams",
+		Name:      "fetches_total",
+		Help:      "Number of fetches of the external upstreams, by URL and result.",
+	}, []string{"url", "result"})
+
+	// BlockedQueries counts the queries answered with the block response.
+	BlockedQueries = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "blocklists",
+		Name:      "blocked_total",
+		Help:      "Number of DNS queries blocked.",
+	})
+
+	// BlocklistsFetches counts the fetches of the blocklists and allowlists, by URL and result.
+	BlocklistsFetches = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "blocklists",
+		Name:      "fetches_total",
+		Help:      "Number of fetches of the blocklists and allowlists, by URL and result.",
+	}, []string{"url", "result"})
+
+	// RPZHits counts the queries matching a response policy, by zone, trigger and action.
+	RPZHits = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "rpz",
+		Name:      "hits_total",
+		Help:      "Number of DNS queries matching a response policy, by zone, trigger and action.",
+	}, []string{"zone", "trigger", "action"})
+
+	// ConfigReloads counts the reloads of the configuration file, by result.
+	ConfigReloads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "config",
+		Name:      "reloads_total",
+		Help:      "Number of reloads of the configuration file, by result.",
+	}, []string{"result"})
+)
+
+// Results of the external upstreams and blocklists fetches, of the configuration reloads and of the prefetches.
+const (
+	ResultSuccess   = "success"
+	ResultUnchanged = "unchanged"
+	ResultError     = "error"
+)
+
+// Limits and actions of the rate limited queries.
+const (
+	LimitClient   = "client"
+	LimitResponse = "response"
+	ActionDrop    = "drop"
+	ActionSlip    = "slip"
+)
+
+// RegisterCacheSize exposes the number of entries of the cache, as returned by size.
+func RegisterCacheSize(size func() int) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "cache",
+		Name:      "entries",
+		Help:      "Number of entries in the cache.",
+	}, func() float64 {
+		return float64(size())
+	})
+}
+
+// RegisterCacheEvictions exposes the number of entries evicted from the full cache, as returned by evictions.
+func RegisterCacheEvictions(evictions func() uint64) {
+	promauto.NewCounterFunc(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "cache",
+		Name:      "evictions_total",
+		Help:      "Number of entries evicted from the cache to respect its size limits.",
+	}, func() float64 {
+		return float64(evictions())
+	})
+}
+
+// NewServer returns the HTTP server exposing the metrics on the given address and path.
+func NewServer(addr, path string) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle(path, promhttp.Handler())
+
+	return &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+}
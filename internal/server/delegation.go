@@ -0,0 +1,69 @@
+package server
+
+import (
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/rs/zerolog/log"
+
+	"github.com/azrod/dnsr/internal/config"
+)
+
+// delegation returns an upstream made of the name servers of the local zone cut of the name,
+// or nil if the name is not delegated by a local zone or its name servers have no address.
+func (h *DNSHandler) delegation(cfg *config.Config, name string, qtype uint16) *config.Upstream {
+	ns, glue := config.Lz.Delegation(name, qtype)
+	if ns == nil {
+		return nil
+	}
+
+	var servers []string
+	for _, rr := range ns {
+		for _, addr := range h.nameServerAddrs(cfg, rr.(*dns.NS).Ns, glue) {
+			servers = append(servers, net.JoinHostPort(addr.String(), "53"))
+		}
+	}
+
+	cut := ns[0].Header().Name
+	if len(servers) == 0 {
+		log.Warn().Msgf("No address for the name servers of the delegation %s, using the upstreams", cut)
+		return nil
+	}
+
+	return &config.Upstream{
+		Name:       "delegation " + cut,
+		DNSServers: servers,
+	}
+}
+
+// nameServerAddrs returns the addresses of the name server, from the glue records, the local data or the upstreams.
+// The name servers delegated themselves are not resolved, they need glue records.
+func (h *DNSHandler) nameServerAddrs(cfg *config.Config, target string, glue []dns.RR) []net.IP {
+	var rrs []dns.RR
+	for _, rr := range glue {
+		if strings.EqualFold(rr.Header().Name, target) {
+			rrs = append(rrs, rr)
+		}
+	}
+
+	if len(rrs) == 0 {
+		if answer, ok := config.Lz.Lookup(target, dns.TypeA); ok {
+			rrs = answer.Answer
+		} else if ns, _ := config.Lz.Delegation(target, dns.TypeA); ns == nil {
+			rrs = h.resolve(cfg, target, dns.TypeA)
+		}
+	}
+
+	var addrs []net.IP
+	for _, rr := range rrs {
+		switch rr := rr.(type) {
+		case *dns.A:
+			addrs = append(addrs, rr.A)
+		case *dns.AAAA:
+			addrs = append(addrs, rr.AAAA)
+		}
+	}
+
+	return addrs
+}
@@ -2,36 +2,80 @@ package server
 
 import (
 	"github.com/miekg/dns"
-	"github.com/rs/zerolog/log"
 )
 
 // Forwards DNS requests to the appropriate upstream server.
+// The upstream matching the domain is tried first, then the default upstream.
 func (d *DNSRequest) Forward(domain string) (dnsRCode int) {
-	// Create a new client
-	c := new(dns.Client)
+	m := d.upstreamRequest()
 
-	dnsServers := d.dnsServers
-	dnsServers = append(dnsServers, d.defaultDNSServers...)
+	var lastResponse *dns.Msg
 
-	m := new(dns.Msg)
-	m.RecursionDesired = true
-
-	// Send the request to the DNS servers
-	for _, dnsServer := range dnsServers {
-		m.SetQuestion(dns.Fqdn(domain), d.msg.Question[0].Qtype)
-		upstreamResponse, timeD, err := c.Exchange(m, dnsServer)
-		if err != nil {
-			log.Error().Msgf("Error getting upstream response: %v", err)
-			continue
+	for _, u := range d.upstreams {
+		upstreamResponse := exchangeUpstream(u, d.timeout, m, domain)
+		if isFinal(upstreamResponse) {
+			d.setResponse(upstreamResponse)
+			return upstreamResponse.Rcode
 		}
-		if upstreamResponse.Rcode == dns.RcodeSuccess {
-			log.Info().Msgf("Sending request to %s for %s took %v", dnsServer, domain, timeD)
-			d.msg.Answer = upstreamResponse.Answer
-			return dns.RcodeSuccess
+		if upstreamResponse != nil {
+			lastResponse = upstreamResponse
 		}
 	}
 
+	// None of the upstream servers gave a final answer
+	// Return the last error they reported
+	if lastResponse != nil {
+		d.setResponse(lastResponse)
+		return lastResponse.Rcode
+	}
+
 	// If we get here, we didn't get a response from any of the upstream servers
 	// Return a SERVFAIL
 	return dns.RcodeServerFailure
 }
+
+// upstreamRequest builds the request sent to the upstream servers from the client request.
+// The question, the DNSSEC flags and the EDNS options of the client are kept.
+func (d *DNSRequest) upstreamRequest() *dns.Msg {
+	m := new(dns.Msg)
+	m.Id = dns.Id()
+	m.RecursionDesired = true
+	m.Question = []dns.Question{d.msg.Question[0]}
+
+	if d.req == nil {
+		return m
+	}
+
+	m.CheckingDisabled = d.req.CheckingDisabled
+	m.AuthenticatedData = d.req.AuthenticatedData
+
+	if opt := d.req.IsEdns0(); opt != nil {
+		m.Extra = append(m.Extra, dns.Copy(opt))
+	}
+
+	return m
+}
+
+// setResponse copies the upstream response into the message sent back to the client.
+func (d *DNSRequest) setResponse(upstreamResponse *dns.Msg) {
+	d.msg.Rcode = upstreamResponse.Rcode
+	d.msg.Answer = upstreamResponse.Answer
+	d.msg.Ns = upstreamResponse.Ns
+	d.msg.AuthenticatedData = upstreamResponse.AuthenticatedData
+	d.msg.RecursionAvailable = upstreamResponse.RecursionAvailable
+
+	d.msg.Extra = d.msg.Extra[:0]
+	for _, rr := range upstreamResponse.Extra {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			continue
+		}
+		d.msg.Extra = append(d.msg.Extra, rr)
+	}
+
+	// EDNS options are only sent back to clients which speak EDNS
+	if d.req != nil && d.req.IsEdns0() != nil {
+		if opt := upstreamResponse.IsEdns0(); opt != nil {
+			d.msg.Extra = append(d.msg.Extra, opt)
+		}
+	}
+}
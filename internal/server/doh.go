@@ -0,0 +1,272 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/miekg/dns"
+	"github.com/rs/zerolog/log"
+
+	"github.com/azrod/dnsr/internal/cache/base"
+)
+
+// dohMediaType is the media type of DNS messages sent over HTTPS (RFC 8484).
+const dohMediaType = "application/dns-message"
+
+// dohGetTemplate is the URI template variable of DoH servers queried with GET (RFC 8484 section 4.1).
+const dohGetTemplate = "{?dns}"
+
+// dohUpstream is a DNS-over-HTTPS server (RFC 8484).
+type dohUpstream struct {
+	url    string
+	useGet bool
+	client *resty.Client
+}
+
+// newDoHUpstream builds a DNS-over-HTTPS upstream from an URL like https://dns.example/dns-query.
+// Requests are sent with POST, unless the URL ends with the {?dns} template
+// (https://dns.example/dns-query{?dns}) in which case they are sent with GET.
+func newDoHUpstream(addr string) *dohUpstream {
+	u := &dohUpstream{url: addr}
+	if strings.HasSuffix(addr, dohGetTemplate) {
+		u.url = strings.TrimSuffix(addr, dohGetTemplate)
+		u.useGet = true
+	}
+
+	// The transport is kept by the upstream to reuse the HTTP/2 connection between requests.
+	// The client has no timeout of its own, the attempts end with the deadline of their context
+	u.client = resty.New().
+		SetTransport(&http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			TLSClientConfig:     &tls.Config{MinVersion: tls.VersionTLS12},
+			ForceAttemptHTTP2:   true,
+			MaxIdleConnsPerHost: 10,
+			IdleConnTimeout:     90 * time.Second,
+		}).
+		SetHeader("Accept", dohMediaType)
+
+	return u
+}
+
+// Exchange sends the request over HTTPS.
+func (u *dohUpstream) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, time.Duration, error) {
+	// The ID is set to 0 to make the requests cacheable by HTTP caches
+	q := m.Copy()
+	q.Id = 0
+
+	packed, err := q.Pack()
+	if err != nil {
+		return nil, 0, fmt.Errorf("error packing DoH request: %w", err)
+	}
+
+	req := u.client.R().SetContext(ctx)
+
+	var resp *resty.Response
+	start := time.Now()
+	if u.useGet {
+		resp, err = req.
+			SetQueryParam("dns", base64.RawURLEncoding.EncodeToString(packed)).
+			Get(u.url)
+	} else {
+		resp, err = req.
+			SetHeader("Content-Type", dohMediaType).
+			SetBody(packed).
+			Post(u.url)
+	}
+	rtt := time.Since(start)
+
+	if err != nil {
+		return nil, rtt, fmt.Errorf("error sending DoH request to %s: %w", u.url, err)
+	}
+
+	if resp.StatusCode() != http.StatusOK {
+		return nil, rtt, fmt.Errorf("error sending DoH request to %s: %s", u.url, resp.Status())
+	}
+
+	if ct := resp.Header().Get("Content-Type"); !isDoHMediaType(ct) {
+		return nil, rtt, fmt.Errorf("unexpected content type %q from %s", ct, u.url)
+	}
+
+	r := new(dns.Msg)
+	if err := r.Unpack(resp.Body()); err != nil {
+		return nil, rtt, fmt.Errorf("error unpacking DoH response from %s: %w", u.url, err)
+	}
+	r.Id = m.Id
+
+	return r, rtt, nil
+}
+
+// isDoHMediaType returns true if the content type is the DoH media type, with or without parameters.
+func isDoHMediaType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && mediaType == dohMediaType
+}
+
+// dohMaxMsgSize is the maximum size of a DNS message received over HTTPS.
+const dohMaxMsgSize = dns.MaxMsgSize
+
+// DoHHandler serves DNS-over-HTTPS requests (RFC 8484) with a DNS handler.
+type DoHHandler struct {
+	Handler dns.Handler
+}
+
+// ServeHTTP decodes the DNS request of a GET or POST request, serves it with the DNS handler
+// and writes back the response.
+func (h *DoHHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var (
+		packed []byte
+		err    error
+	)
+
+	switch r.Method {
+	case http.MethodGet:
+		packed, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+	case http.MethodPost:
+		if ct := r.Header.Get("Content-Type"); !isDoHMediaType(ct) {
+			http.Error(w, fmt.Sprintf("unsupported content type %q", ct), http.StatusUnsupportedMediaType)
+			return
+		}
+		packed, err = io.ReadAll(io.LimitReader(r.Body, dohMaxMsgSize))
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error reading DNS request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	req := new(dns.Msg)
+	if err := req.Unpack(packed); err != nil || len(req.Question) == 0 {
+		http.Error(w, "invalid DNS request", http.StatusBadRequest)
+		return
+	}
+
+	dw := &dohResponseWriter{
+		remoteAddr: parseHTTPAddr(r.RemoteAddr),
+	}
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		dw.localAddr = addr
+	}
+
+	h.Handler.ServeDNS(dw, req)
+
+	if dw.msg == nil && dw.dropStatus != 0 {
+		http.Error(w, http.StatusText(dw.dropStatus), dw.dropStatus)
+		return
+	}
+
+	if dw.msg == nil {
+		http.Error(w, "no DNS response", http.StatusInternalServerError)
+		return
+	}
+
+	resp, err := dw.msg.Pack()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error packing DNS response: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", dohMediaType)
+	// The freshness lifetime of the HTTP response is the lowest TTL of the answer (RFC 8484 section 5.1)
+	if len(dw.msg.Answer) > 0 {
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", base.MinTTL(dw.msg.Answer)))
+	}
+
+	if _, err := w.Write(resp); err != nil {
+		log.Error().Err(err).Msg("Error writing DoH response")
+	}
+}
+
+// parseHTTPAddr converts the remote address of an HTTP request to a net.Addr.
+func parseHTTPAddr(addr string) net.Addr {
+	ap, err := netip.ParseAddrPort(addr)
+	if err != nil {
+		return &net.TCPAddr{}
+	}
+
+	return net.TCPAddrFromAddrPort(ap)
+}
+
+// dohResponseWriter is the dns.ResponseWriter of a DNS-over-HTTPS request.
+// It keeps the response so that it is written in the HTTP response.
+type dohResponseWriter struct {
+	localAddr  net.Addr
+	remoteAddr net.Addr
+	msg        *dns.Msg
+	// dropStatus is the HTTP status of a request dropped by the DNS handler.
+	dropStatus int
+}
+
+var (
+	_ dns.ResponseWriter = &dohResponseWriter{}
+	_ dropper            = &dohResponseWriter{}
+)
+
+// Drop keeps the HTTP status of the dropped request.
+func (w *dohResponseWriter) Drop(reason dropReason) {
+	switch reason {
+	case dropRateLimited:
+		w.dropStatus = http.StatusTooManyRequests
+	default:
+		w.dropStatus = http.StatusForbidden
+	}
+}
+
+// LocalAddr returns the local address of the HTTP connection.
+func (w *dohResponseWriter) LocalAddr() net.Addr {
+	if w.localAddr == nil {
+		return &net.TCPAddr{}
+	}
+
+	return w.localAddr
+}
+
+// RemoteAddr returns the address of the HTTP client.
+func (w *dohResponseWriter) RemoteAddr() net.Addr {
+	return w.remoteAddr
+}
+
+// WriteMsg keeps the response.
+func (w *dohResponseWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+// Write keeps the packed response.
+func (w *dohResponseWriter) Write(b []byte) (int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		return 0, err
+	}
+	w.msg = m
+
+	return len(b), nil
+}
+
+// Close does nothing, the HTTP server handles the connection.
+func (w *dohResponseWriter) Close() error {
+	return nil
+}
+
+// TsigStatus returns nil, TSIG is not supported over HTTPS.
+func (w *dohResponseWriter) TsigStatus() error {
+	return nil
+}
+
+// TsigTimersOnly does nothing, TSIG is not supported over HTTPS.
+func (w *dohResponseWriter) TsigTimersOnly(bool) {}
+
+// Hijack does nothing, the HTTP server handles the connection.
+func (w *dohResponseWriter) Hijack() {}
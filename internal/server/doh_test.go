@@ -0,0 +1,278 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// newTestDoHUpstream returns an upstream for the URL trusting the certificate of the test server.
+func newTestDoHUpstream(srv *httptest.Server, url string) *dohUpstream {
+	u := newDoHUpstream(url)
+	u.client.SetTransport(srv.Client().Transport)
+
+	return u
+}
+
+// answerA answers the A queries with 192.0.2.1.
+func answerA(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Answer = []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.IPv4(192, 0, 2, 1),
+	}}
+	_ = w.WriteMsg(m)
+}
+
+func testQuery() *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+
+	return m
+}
+
+func TestDoHUpstreamExchange(t *testing.T) {
+	tests := []struct {
+		name        string
+		path        string
+		contentType string
+		wantMethod  string
+	}{
+		{name: "post", path: "/dns-query", contentType: dohMediaType, wantMethod: http.MethodPost},
+		{name: "get template", path: "/dns-query" + dohGetTemplate, contentType: dohMediaType, wantMethod: http.MethodGet},
+		{name: "content type parameters", path: "/dns-query", contentType: "Application/DNS-Message; charset=binary", wantMethod: http.MethodPost},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != tt.wantMethod {
+					t.Errorf("got method %s, want %s", r.Method, tt.wantMethod)
+				}
+				if r.URL.Path != "/dns-query" {
+					t.Errorf("got path %s, want /dns-query", r.URL.Path)
+				}
+				if accept := r.Header.Get("Accept"); accept != dohMediaType {
+					t.Errorf("got accept %q, want %q", accept, dohMediaType)
+				}
+
+				var (
+					packed []byte
+					err    error
+				)
+				if r.Method == http.MethodGet {
+					packed, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+				} else {
+					if ct := r.Header.Get("Content-Type"); ct != dohMediaType {
+						t.Errorf("got content type %q, want %q", ct, dohMediaType)
+					}
+					packed, err = io.ReadAll(r.Body)
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				req := new(dns.Msg)
+				if err := req.Unpack(packed); err != nil {
+					t.Fatal(err)
+				}
+				if req.Id != 0 {
+					t.Errorf("got request ID %d, want 0", req.Id)
+				}
+
+				resp := new(dns.Msg)
+				resp.SetReply(req)
+				resp.Answer = []dns.RR{&dns.A{
+					Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+					A:   net.IPv4(192, 0, 2, 1),
+				}}
+				out, _ := resp.Pack()
+
+				w.Header().Set("Content-Type", tt.contentType)
+				_, _ = w.Write(out)
+			}))
+			defer srv.Close()
+
+			q := testQuery()
+			r, _, err := newTestDoHUpstream(srv, srv.URL+tt.path).Exchange(context.Background(), q)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if r.Id != q.Id {
+				t.Errorf("got response ID %d, want %d", r.Id, q.Id)
+			}
+			if len(r.Answer) != 1 || r.Answer[0].(*dns.A).A.String() != "192.0.2.1" {
+				t.Errorf("got answer %v, want 192.0.2.1", r.Answer)
+			}
+		})
+	}
+}
+
+func TestDoHUpstreamExchangeErrors(t *testing.T) {
+	tests := []struct {
+		name        string
+		status      int
+		contentType string
+	}{
+		{name: "server error", status: http.StatusServiceUnavailable, contentType: dohMediaType},
+		{name: "content type", status: http.StatusOK, contentType: "text/html"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.Header().Set("Content-Type", tt.contentType)
+				w.WriteHeader(tt.status)
+			}))
+			defer srv.Close()
+
+			if _, _, err := newTestDoHUpstream(srv, srv.URL+"/dns-query").Exchange(context.Background(), testQuery()); err == nil {
+				t.Error("got no error")
+			}
+		})
+	}
+}
+
+func TestDoHUpstreamExchangeTimeout(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	// The attempt ends with the deadline of the context, the timeout of the upstream
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, _, err := newTestDoHUpstream(srv, srv.URL+"/dns-query").Exchange(ctx, testQuery()); err == nil {
+		t.Error("got no error")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("got an answer after %v, want the deadline of the context", elapsed)
+	}
+}
+
+func TestDoHHandler(t *testing.T) {
+	srv := httptest.NewTLSServer(&DoHHandler{Handler: dns.HandlerFunc(answerA)})
+	defer srv.Close()
+
+	for _, path := range []string{"/dns-query", "/dns-query" + dohGetTemplate} {
+		t.Run(path, func(t *testing.T) {
+			q := testQuery()
+			r, _, err := newTestDoHUpstream(srv, srv.URL+path).Exchange(context.Background(), q)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if r.Rcode != dns.RcodeSuccess || len(r.Answer) != 1 {
+				t.Errorf("got %s with %d answers, want NOERROR with 1 answer", dns.RcodeToString[r.Rcode], len(r.Answer))
+			}
+		})
+	}
+
+	packed, err := testQuery().Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		method      string
+		contentType string
+		body        []byte
+		wantStatus  int
+	}{
+		{name: "post", method: http.MethodPost, contentType: dohMediaType, body: packed, wantStatus: http.StatusOK},
+		{name: "content type", method: http.MethodPost, contentType: "text/plain", body: packed, wantStatus: http.StatusUnsupportedMediaType},
+		{name: "content type parameters", method: http.MethodPost, contentType: dohMediaType + "; charset=binary", body: packed, wantStatus: http.StatusOK},
+		{name: "method", method: http.MethodPut, contentType: dohMediaType, body: packed, wantStatus: http.StatusMethodNotAllowed},
+		{name: "invalid message", method: http.MethodPost, contentType: dohMediaType, body: []byte{1, 2, 3}, wantStatus: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, srv.URL+"/dns-query", bytes.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Content-Type", tt.contentType)
+
+			client := srv.Client()
+			client.Timeout = 5 * time.Second
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("got status %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+
+			if ct := resp.Header.Get("Content-Type"); ct != dohMediaType {
+				t.Errorf("got content type %q, want %q", ct, dohMediaType)
+			}
+			if cc := resp.Header.Get("Cache-Control"); cc != "max-age=60" {
+				t.Errorf("got cache control %q, want max-age=60", cc)
+			}
+		})
+	}
+}
+
+func TestDoHHandlerDrop(t *testing.T) {
+	tests := []struct {
+		name       string
+		handler    dns.HandlerFunc
+		wantStatus int
+	}{
+		{
+			name:       "denied",
+			handler:    func(w dns.ResponseWriter, _ *dns.Msg) { dropResponse(w, dropDenied) },
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "rate limited",
+			handler:    func(w dns.ResponseWriter, _ *dns.Msg) { dropResponse(w, dropRateLimited) },
+			wantStatus: http.StatusTooManyRequests,
+		},
+		{
+			name:       "no response",
+			handler:    func(dns.ResponseWriter, *dns.Msg) {},
+			wantStatus: http.StatusInternalServerError,
+		},
+	}
+
+	packed, err := testQuery().Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/dns-query", bytes.NewReader(packed))
+			req.Header.Set("Content-Type", dohMediaType)
+			rec := httptest.NewRecorder()
+
+			(&DoHHandler{Handler: tt.handler}).ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("got status %d, want %d", rec.Code, tt.wantStatus)
+			}
+		})
+	}
+}
@@ -0,0 +1,253 @@
+package server
+
+import (
+	"context"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rs/zerolog/log"
+
+	"github.com/azrod/dnsr/internal/config"
+	"github.com/azrod/dnsr/internal/metrics"
+)
+
+// latencyWeight is the weight of the last measure in the moving average of the upstream latencies.
+const latencyWeight = 0.3
+
+// serversHealth holds the health of each upstream server.
+var serversHealth sync.Map
+
+type (
+	// serverHealth is the health of an upstream server.
+	serverHealth struct {
+		mu sync.Mutex
+		// latency is the moving average of the latency of the server.
+		latency time.Duration
+		// failures is the number of consecutive failures.
+		failures int
+		healthy  bool
+	}
+
+	// UpstreamStatus is the health of an upstream server, as reported in logs and metrics.
+	UpstreamStatus struct {
+		Server              string
+		Healthy             bool
+		ConsecutiveFailures int
+		Latency             time.Duration
+	}
+)
+
+// getServerHealth returns the health of the server, servers are healthy until they fail.
+func getServerHealth(server string) *serverHealth {
+	h, loaded := serversHealth.LoadOrStore(server, &serverHealth{healthy: true})
+	if !loaded {
+		metrics.UpstreamHealthy.WithLabelValues(server).Set(1)
+	}
+
+	return h.(*serverHealth)
+}
+
+// recordSuccess records an answer of the server and adds its latency to the moving average.
+func recordSuccess(server string, rtt time.Duration) {
+	h := getServerHealth(server)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.latency == 0 {
+		h.latency = rtt
+	} else {
+		h.latency = time.Duration(latencyWeight*float64(rtt) + (1-latencyWeight)*float64(h.latency))
+	}
+
+	h.failures = 0
+	if !h.healthy {
+		h.healthy = true
+		metrics.UpstreamHealthy.WithLabelValues(server).Set(1)
+		log.Info().Msgf("Upstream %s is healthy again", server)
+	}
+}
+
+// recordFailure records a failure of the server.
+// A failure counts as a slow answer for the lowest-latency strategy.
+// The server is only marked unhealthy when the health checks are enabled.
+func recordFailure(server string, timeout time.Duration) {
+	h := getServerHealth(server)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.latency == 0 {
+		h.latency = timeout
+	} else {
+		h.latency = time.Duration(latencyWeight*float64(timeout) + (1-latencyWeight)*float64(h.latency))
+	}
+
+	h.failures++
+	if hc := config.Get().Server.HealthCheck; hc.Enabled && h.healthy && h.failures >= hc.GetFailureThreshold() {
+		h.healthy = false
+		metrics.UpstreamHealthy.WithLabelValues(server).Set(0)
+		log.Warn().Msgf("Upstream %s is unhealthy after %d consecutive failures", server, h.failures)
+	}
+}
+
+// getLatency returns the moving average of the latency of the server.
+// Servers never measured have no latency.
+func getLatency(server string) time.Duration {
+	h, ok := serversHealth.Load(server)
+	if !ok {
+		return 0
+	}
+
+	sh := h.(*serverHealth)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	return sh.latency
+}
+
+// isHealthy returns true if the server is healthy.
+func isHealthy(server string) bool {
+	h, ok := serversHealth.Load(server)
+	if !ok {
+		return true
+	}
+
+	sh := h.(*serverHealth)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	return sh.healthy
+}
+
+// healthyServers returns the healthy servers of the list.
+// If none of them is healthy, all the servers are returned so that the request is still attempted.
+// Unhealthy servers are only skipped when the health checks are enabled, a successful probe brings them back.
+func healthyServers(servers []string) []string {
+	if !config.Get().Server.HealthCheck.Enabled {
+		return servers
+	}
+
+	healthy := make([]string, 0, len(servers))
+	for _, server := range servers {
+		if isHealthy(server) {
+			healthy = append(healthy, server)
+		}
+	}
+
+	if len(healthy) == 0 {
+		return servers
+	}
+
+	return healthy
+}
+
+// GetUpstreamsStatus returns the health of the upstream servers, sorted by server.
+func GetUpstreamsStatus() []UpstreamStatus {
+	var status []UpstreamStatus
+	serversHealth.Range(func(k, v any) bool {
+		h := v.(*serverHealth)
+		h.mu.Lock()
+		status = append(status, UpstreamStatus{
+			Server:              k.(string),
+			Healthy:             h.healthy,
+			ConsecutiveFailures: h.failures,
+			Latency:             h.latency,
+		})
+		h.mu.Unlock()
+		return true
+	})
+
+	sort.Slice(status, func(i, j int) bool {
+		return status[i].Server < status[j].Server
+	})
+
+	return status
+}
+
+// StartHealthChecks probes the upstream servers at the configured interval until done is closed.
+// The configuration is read again at each interval, the health checks are enabled or disabled on reload.
+func StartHealthChecks(done <-chan bool) {
+	go func() {
+		timer := time.NewTimer(0)
+		defer timer.Stop()
+
+		for {
+			select {
+			case <-timer.C:
+			case <-done:
+				return
+			}
+
+			hc := config.Get().Server.HealthCheck
+			if hc.Enabled {
+				checkServers()
+			}
+			timer.Reset(hc.GetInterval())
+		}
+	}()
+}
+
+// checkServers probes all the upstream servers of the configuration.
+func checkServers() {
+	cfg := config.Get()
+
+	var wg sync.WaitGroup
+	for _, server := range configuredServers(cfg) {
+		wg.Add(1)
+		go func(server string) {
+			defer wg.Done()
+			probe(cfg.Server, server)
+		}(server)
+	}
+	wg.Wait()
+
+	for _, s := range GetUpstreamsStatus() {
+		log.Debug().Msgf("Upstream %s healthy=%t failures=%d latency=%v", s.Server, s.Healthy, s.ConsecutiveFailures, s.Latency)
+	}
+}
+
+// configuredServers returns the servers of the default upstream and of the upstreams, without duplicates.
+func configuredServers(cfg *config.Config) []string {
+	servers := slices.Clone(cfg.Server.DefaultUpstream)
+	for _, u := range cfg.GetUpstreams() {
+		servers = append(servers, u.DNSServers...)
+	}
+
+	slices.Sort(servers)
+	return slices.Compact(servers)
+}
+
+// probe sends the health check query to the server and records the result.
+// Any answer means the server is working, a SERVFAIL is an answer about the domain like in exchange.
+func probe(s config.Server, server string) {
+	hc := s.HealthCheck
+	timeout := s.GetUpstreamTimeout()
+
+	u, err := getUpstream(server)
+	if err != nil {
+		log.Error().Err(err).Msgf("Error getting upstream %s to probe", server)
+		return
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion(hc.GetDomain(), dns.TypeNS)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	r, rtt, err := u.Exchange(ctx, m)
+	switch {
+	case err != nil:
+		log.Debug().Err(err).Msgf("Health check of upstream %s failed", server)
+		recordFailure(server, timeout)
+	default:
+		if r.Rcode == dns.RcodeServerFailure {
+			log.Debug().Msgf("Health check of upstream %s returned SERVFAIL", server)
+		}
+		recordSuccess(server, rtt)
+	}
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/azrod/dnsr/internal/config"
+)
+
+func TestProbe(t *testing.T) {
+	tests := []struct {
+		name        string
+		rcode       int
+		wantHealthy bool
+	}{
+		{name: "answer", rcode: dns.RcodeSuccess, wantHealthy: true},
+		{name: "servfail", rcode: dns.RcodeServerFailure, wantHealthy: true},
+		{name: "no answer", rcode: -1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := startTestUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+				if tt.rcode < 0 {
+					return
+				}
+				m := new(dns.Msg)
+				m.SetRcode(r, tt.rcode)
+				_ = w.WriteMsg(m)
+			})
+			writeTestConfig(t, filepath.Join(t.TempDir(), "config.yaml"), fmt.Sprintf(`server:
+  defaultUpstream: [%s]
+  upstreamTimeout: 200
+  healthCheck:
+    enabled: true
+    failureThreshold: 1
+`, server))
+			t.Cleanup(func() { serversHealth.Delete(server) })
+
+			probe(config.Get().Server, server)
+
+			if healthy := isHealthy(server); healthy != tt.wantHealthy {
+				t.Errorf("got healthy %t, want %t", healthy, tt.wantHealthy)
+			}
+		})
+	}
+}
+
+func TestHealthyServersReload(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	servers := []string{"192.0.2.1:53", "192.0.2.2:53"}
+	t.Cleanup(func() {
+		for _, server := range servers {
+			serversHealth.Delete(server)
+		}
+	})
+
+	writeTestConfig(t, file, "server:\n  healthCheck:\n    enabled: true\n    failureThreshold: 1\n")
+	recordFailure(servers[0], time.Second)
+	if got := healthyServers(servers); !slices.Equal(got, servers[1:]) {
+		t.Errorf("got %v with health checks, want %v", got, servers[1:])
+	}
+
+	// The unhealthy servers are used again when the health checks are disabled
+	writeTestConfig(t, file, "server:\n  healthCheck:\n    enabled: false\n")
+	if got := healthyServers(servers); !slices.Equal(got, servers) {
+		t.Errorf("got %v without health checks, want %v", got, servers)
+	}
+}
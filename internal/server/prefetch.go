@@ -0,0 +1,97 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rs/zerolog/log"
+
+	"github.com/azrod/dnsr/internal/cache/base"
+	"github.com/azrod/dnsr/internal/config"
+	"github.com/azrod/dnsr/internal/metrics"
+)
+
+const (
+	// prefetchInterval is the interval between two searches of the entries to prefetch.
+	prefetchInterval = time.Second
+	// prefetchWorkers is the maximum number of entries prefetched at once.
+	prefetchWorkers = 8
+)
+
+// StartPrefetch resolves the popular cache entries again before they expire, until done is closed.
+func (h *DNSHandler) StartPrefetch(done <-chan bool) {
+	if h.Cache == nil || !config.Get().Cache.Prefetch.Enabled {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(prefetchInterval)
+		defer ticker.Stop()
+
+		var (
+			mu       sync.Mutex
+			inflight = make(map[base.Key]bool)
+			workers  = make(chan struct{}, prefetchWorkers)
+		)
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-done:
+				return
+			}
+
+			cfg := config.Get()
+			p := cfg.Cache.Prefetch
+			for _, key := range h.Cache.PrefetchKeys(p.GetMinHits(), p.GetThreshold()) {
+				// The entries still being prefetched from the previous search are skipped
+				mu.Lock()
+				if inflight[key] {
+					mu.Unlock()
+					continue
+				}
+				inflight[key] = true
+				mu.Unlock()
+
+				workers <- struct{}{}
+				go func(key base.Key) {
+					defer func() {
+						<-workers
+						mu.Lock()
+						delete(inflight, key)
+						mu.Unlock()
+					}()
+
+					h.prefetch(cfg, key)
+				}(key)
+			}
+		}
+	}()
+}
+
+// prefetch resolves the entry of the key again and caches the response.
+func (h *DNSHandler) prefetch(cfg *config.Config, key base.Key) {
+	req := new(dns.Msg)
+	req.SetQuestion(key.Name, key.Qtype)
+	req.Question[0].Qclass = key.Qclass
+
+	// The answers of an upstream depending on the client are prefetched from the same upstream
+	var upstream *config.Upstream
+	if key.Upstream != "" {
+		if upstream = config.Md.GetByCacheID(key.Upstream); upstream == nil {
+			log.Debug().Msgf("Not prefetching %s, its upstream is no longer configured", key)
+			return
+		}
+	}
+
+	log.Debug().Msgf("Prefetching %s", key)
+
+	result := metrics.ResultSuccess
+	switch h.forward(cfg, req, upstream).Rcode {
+	case dns.RcodeSuccess, dns.RcodeNameError:
+	default:
+		result = metrics.ResultError
+	}
+	metrics.CachePrefetches.WithLabelValues(result).Inc()
+}
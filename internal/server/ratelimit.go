@@ -0,0 +1,113 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/azrod/dnsr/internal/config"
+)
+
+// rateLimiterSweep is the interval between two removals of the idle buckets.
+const rateLimiterSweep = time.Minute
+
+var (
+	// clientLimiter limits the queries of each client prefix.
+	clientLimiter = newRateLimiter()
+	// responseLimiter limits the identical responses sent to each client prefix.
+	responseLimiter = newRateLimiter()
+)
+
+type (
+	// rateLimiter holds token buckets by key.
+	rateLimiter struct {
+		mu      sync.Mutex
+		buckets map[string]*bucket
+		swept   time.Time
+	}
+
+	bucket struct {
+		tokens float64
+		last   time.Time
+		// limited is the number of requests limited since the bucket was created.
+		limited int
+	}
+)
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{
+		buckets: make(map[string]*bucket),
+		swept:   time.Now(),
+	}
+}
+
+// allow takes a token from the bucket of the key, buckets are refilled at rate tokens per second up to burst.
+// It returns false and the number of requests limited so far when the bucket is empty.
+func (l *rateLimiter) allow(key string, rate float64, burst int) (bool, int) {
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.swept) > rateLimiterSweep {
+		l.sweep(now, rate, burst)
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(burst), last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = min(float64(burst), b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		b.limited++
+		return false, b.limited
+	}
+
+	b.tokens--
+	return true, 0
+}
+
+// sweep removes the buckets which would be full, they are created again when needed.
+func (l *rateLimiter) sweep(now time.Time, rate float64, burst int) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*rate >= float64(burst) {
+			delete(l.buckets, key)
+		}
+	}
+	l.swept = now
+}
+
+// responseKey returns the key of the identical responses: the client prefix, the name and the response code.
+// The negative answers of all the names share a key, as the names of a random subdomain attack differ.
+func responseKey(prefix string, msg *dns.Msg) string {
+	name := msg.Question[0].Name
+	if msg.Rcode == dns.RcodeNameError || len(msg.Answer) == 0 {
+		name = "*"
+	}
+
+	return fmt.Sprintf("%s/%s/%d", prefix, name, msg.Rcode)
+}
+
+// limitResponse applies the response rate limit to a UDP response.
+// It returns send false if the response is dropped, and slipped true if it has been truncated.
+func limitResponse(rrl config.RRL, prefix string, msg *dns.Msg) (send, slipped bool) {
+	ok, limited := responseLimiter.allow(responseKey(prefix, msg), rrl.ResponsesPerSecond, rrl.GetBurst())
+	if ok {
+		return true, false
+	}
+
+	// Every slip limited responses, the client is asked to retry over TCP
+	if slip := rrl.GetSlip(); slip > 0 && limited%slip == 0 {
+		msg.Truncated = true
+		msg.Answer, msg.Ns, msg.Extra = nil, nil, nil
+		return true, true
+	}
+
+	return false, false
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/azrod/dnsr/internal/config"
+)
+
+// testResponse returns an answer to the query of the name with the response code.
+func testResponse(t *testing.T, name string, rcode int) *dns.Msg {
+	t.Helper()
+
+	req := new(dns.Msg)
+	req.SetQuestion(name, dns.TypeA)
+	msg := new(dns.Msg)
+	msg.SetRcode(req, rcode)
+	if rcode == dns.RcodeSuccess {
+		msg.Answer = []dns.RR{testRR(t, name+" 300 IN A 192.0.2.1")}
+	}
+
+	return msg
+}
+
+func TestLimitResponse(t *testing.T) {
+	// The rate is low enough for the bucket not to be refilled during the test
+	const rate = 0.001
+
+	// The responses are sent (s), truncated (t) or dropped (d)
+	tests := []struct {
+		name string
+		slip int
+		want string
+	}{
+		{name: "default slip", want: "ssdtdtdt"},
+		{name: "truncate all", slip: 1, want: "ssttttt"},
+		{name: "slip 3", slip: 3, want: "ssddtddt"},
+		{name: "drop all", slip: -1, want: "ssdddd"},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rrl := config.RRL{Enabled: true, ResponsesPerSecond: rate, Burst: 2, Slip: tt.slip}
+			prefix := fmt.Sprintf("198.51.100.%d/32", i)
+
+			var got []byte
+			for range tt.want {
+				msg := testResponse(t, "www.example.com.", dns.RcodeSuccess)
+				send, slipped := limitResponse(rrl, prefix, msg)
+
+				switch {
+				case !send:
+					got = append(got, 'd')
+				case slipped:
+					got = append(got, 't')
+					if !msg.Truncated || len(msg.Answer) != 0 {
+						t.Errorf("got truncated %t with answer %v, want truncated without answer", msg.Truncated, msg.Answer)
+					}
+				default:
+					got = append(got, 's')
+					if msg.Truncated || len(msg.Answer) != 1 {
+						t.Errorf("got truncated %t with answer %v, want the answer", msg.Truncated, msg.Answer)
+					}
+				}
+			}
+
+			if string(got) != tt.want {
+				t.Errorf("got responses %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLimitResponseKey(t *testing.T) {
+	rrl := config.RRL{Enabled: true, ResponsesPerSecond: 0.001, Burst: 1, Slip: -1}
+
+	// Each response is the first of its key, except the negative answers of other names
+	responses := []struct {
+		prefix string
+		name   string
+		rcode  int
+	}{
+		{prefix: "203.0.113.0/24", name: "a.example.com.", rcode: dns.RcodeSuccess},
+		{prefix: "203.0.113.0/24", name: "b.example.com.", rcode: dns.RcodeSuccess},
+		{prefix: "203.0.113.0/24", name: "a.example.com.", rcode: dns.RcodeServerFailure},
+		{prefix: "203.0.114.0/24", name: "a.example.com.", rcode: dns.RcodeSuccess},
+		{prefix: "203.0.113.0/24", name: "x1.example.com.", rcode: dns.RcodeNameError},
+		{prefix: "203.0.113.0/24", name: "x2.example.com.", rcode: dns.RcodeNameError},
+	}
+	want := []bool{true, true, true, true, true, false}
+
+	var got []bool
+	for _, r := range responses {
+		send, _ := limitResponse(rrl, r.prefix, testResponse(t, r.name, r.rcode))
+		got = append(got, send)
+	}
+
+	if !slices.Equal(got, want) {
+		t.Errorf("got sent %v, want %v", got, want)
+	}
+}
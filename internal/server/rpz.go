@@ -0,0 +1,167 @@
+package server
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+	"github.com/rs/zerolog/log"
+
+	"github.com/azrod/dnsr/internal/cache/base"
+	"github.com/azrod/dnsr/internal/config"
+	"github.com/azrod/dnsr/internal/metrics"
+)
+
+// enforcePolicy applies the response policy to the response.
+// It returns applied if the response has been replaced, and drop if no response must be sent.
+func (h *DNSHandler) enforcePolicy(cfg *config.Config, w dns.ResponseWriter, msg *dns.Msg, p *config.Policy) (applied, drop bool) {
+	q := msg.Question[0]
+	log.Info().Msgf("Policy %s of zone %s matched %s %s (%s) from %s: %s",
+		p.Rule, p.Zone, q.Name, dns.TypeToString[q.Qtype], p.Trigger, w.RemoteAddr(), p.Action)
+	metrics.RPZHits.WithLabelValues(p.Zone, p.Trigger, p.Action).Inc()
+
+	switch p.Action {
+	case config.ActionPassthru:
+		return false, false
+	case config.ActionDrop:
+		dropResponse(w, dropDenied)
+		return true, true
+	case config.ActionTCPOnly:
+		// The client retries over TCP, where the query is not rewritten
+		if w.LocalAddr().Network() != "udp" {
+			return false, false
+		}
+		msg.Truncated = true
+		msg.Answer, msg.Ns = nil, nil
+	case config.ActionNXDomain:
+		msg.Rcode = dns.RcodeNameError
+		msg.Answer, msg.Ns = nil, nil
+	case config.ActionNoData:
+		msg.Rcode = dns.RcodeSuccess
+		msg.Answer, msg.Ns = nil, nil
+	case config.ActionLocalData:
+		msg.Rcode = dns.RcodeSuccess
+		msg.Answer, msg.Ns = nil, nil
+		h.setPolicyData(cfg, msg, p)
+	}
+
+	return true, false
+}
+
+// setPolicyData answers the records of the local data policy with the query name as owner.
+// Without records of the query type, a CNAME record rewrites the query to its target.
+func (h *DNSHandler) setPolicyData(cfg *config.Config, msg *dns.Msg, p *config.Policy) {
+	q := msg.Question[0]
+
+	var cname *dns.CNAME
+	for _, rr := range p.Records {
+		if c, ok := rr.(*dns.CNAME); ok {
+			cname = c
+		}
+		if rr.Header().Rrtype == q.Qtype || q.Qtype == dns.TypeANY {
+			rr = dns.Copy(rr)
+			rr.Header().Name = q.Name
+			msg.Answer = append(msg.Answer, rr)
+		}
+	}
+
+	if len(msg.Answer) > 0 || cname == nil {
+		return
+	}
+
+	rr := dns.Copy(cname)
+	rr.Header().Name = q.Name
+	msg.Answer = append(msg.Answer, rr)
+	msg.Answer = append(msg.Answer, h.resolve(cfg, cname.Target, q.Qtype)...)
+}
+
+// matchResponsePolicy returns the response policy matching the addresses of the answer
+// or the name servers of the query name.
+func (h *DNSHandler) matchResponsePolicy(cfg *config.Config, msg *dns.Msg) *config.Policy {
+	var ips []net.IP
+	for _, rr := range msg.Answer {
+		switch rr := rr.(type) {
+		case *dns.A:
+			ips = append(ips, rr.A)
+		case *dns.AAAA:
+			ips = append(ips, rr.AAAA)
+		}
+	}
+
+	return config.Rpz.MatchResponse(ips, func() []string {
+		return h.nameServers(cfg, msg.Question[0].Name)
+	})
+}
+
+// nameServers returns the name servers of the closest zone of the name.
+func (h *DNSHandler) nameServers(cfg *config.Config, name string) []string {
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		var ns []string
+		for _, rr := range h.resolve(cfg, name[off:], dns.TypeNS) {
+			if n, ok := rr.(*dns.NS); ok {
+				ns = append(ns, n.Ns)
+			}
+		}
+
+		if len(ns) > 0 {
+			return ns
+		}
+	}
+
+	return nil
+}
+
+// resolve returns the answer to a query made by dnsr itself, from the cache or the upstreams.
+func (h *DNSHandler) resolve(cfg *config.Config, name string, qtype uint16) []dns.RR {
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(name), qtype)
+
+	key := base.NewKey(req.Question[0])
+	if h.Cache != nil {
+		// The queries made by dnsr itself do not make the entries popular
+		if value, ok := h.Cache.Peek(key); ok && !value.HasExpired() {
+			return value.Value
+		}
+	}
+
+	return h.forward(cfg, req, nil).Answer
+}
+
+// forward sends a query made by dnsr itself to the upstream, or to the upstream of its name if nil,
+// and caches the response.
+func (h *DNSHandler) forward(cfg *config.Config, req *dns.Msg, upstream *config.Upstream) *dns.Msg {
+	msg := new(dns.Msg)
+	msg.SetReply(req)
+
+	dr := DNSRequest{
+		req:     req,
+		msg:     msg,
+		timeout: cfg.Server.GetUpstreamTimeout(),
+	}
+
+	// The upstreams depending on the client do not apply
+	q := req.Question[0]
+	if upstream == nil {
+		upstream = h.delegation(cfg, q.Name, q.Qtype)
+	}
+	if upstream == nil {
+		if u := config.Md.Get(config.Query{Name: q.Name, Qtype: q.Qtype}); u != nil && !u.HasClientConditions() {
+			upstream = u
+		}
+	}
+
+	key := base.NewKey(q)
+	if upstream != nil {
+		dr.upstreams = append(dr.upstreams, upstream)
+		key.Upstream = upstream.CacheID()
+	}
+	dr.upstreams = append(dr.upstreams, cfg.Server.GetDefaultUpstream())
+
+	switch dr.Forward(q.Name) {
+	case dns.RcodeSuccess, dns.RcodeNameError:
+		if h.Cache != nil {
+			h.cacheResponse(key, msg)
+		}
+	}
+
+	return msg
+}
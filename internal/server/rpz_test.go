@@ -0,0 +1,124 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"github.com/azrod/dnsr/internal/cache/base"
+	"github.com/azrod/dnsr/internal/cache/memory"
+	"github.com/azrod/dnsr/internal/config"
+)
+
+// dropResponseWriter records the reason of a dropped response.
+type dropResponseWriter struct {
+	testResponseWriter
+	reason dropReason
+}
+
+func (w *dropResponseWriter) Drop(reason dropReason) {
+	w.reason = reason
+}
+
+func TestEnforcePolicy(t *testing.T) {
+	c, err := memory.New(base.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := dns.Question{Name: "www.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	if err := c.Set(base.NewKey(target), []dns.RR{testRR(t, "www.example.com. 300 IN A 192.0.2.80")}); err != nil {
+		t.Fatal(err)
+	}
+	h := &DNSHandler{Cache: c}
+
+	tests := []struct {
+		name        string
+		action      string
+		records     []string
+		wantApplied bool
+		wantDrop    bool
+		wantRcode   int
+		wantAnswer  []string
+	}{
+		{name: "nxdomain", action: config.ActionNXDomain, wantApplied: true, wantRcode: dns.RcodeNameError},
+		{name: "nodata", action: config.ActionNoData, wantApplied: true},
+		{name: "passthru", action: config.ActionPassthru, wantAnswer: []string{"192.0.2.1"}},
+		{name: "drop", action: config.ActionDrop, wantApplied: true, wantDrop: true},
+		{
+			name:        "local data",
+			action:      config.ActionLocalData,
+			records:     []string{"data.rpz.test. 300 IN A 192.0.2.10", "data.rpz.test. 300 IN TXT \"blocked\""},
+			wantApplied: true,
+			wantAnswer:  []string{"192.0.2.10"},
+		},
+		{
+			name:        "cname local data",
+			action:      config.ActionLocalData,
+			records:     []string{"alias.rpz.test. 300 IN CNAME www.example.com."},
+			wantApplied: true,
+			wantAnswer:  []string{"www.example.com.", "192.0.2.80"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &config.Policy{Zone: "rpz.test.", Trigger: config.TriggerQName, Rule: "blocked.rpz.test.", Action: tt.action}
+			for _, r := range tt.records {
+				p.Records = append(p.Records, testRR(t, r))
+			}
+
+			req := new(dns.Msg)
+			req.SetQuestion("blocked.example.", dns.TypeA)
+			msg := new(dns.Msg)
+			msg.SetReply(req)
+			msg.Answer = []dns.RR{testRR(t, "blocked.example. 300 IN A 192.0.2.1")}
+
+			w := &dropResponseWriter{}
+			applied, drop := h.enforcePolicy(&config.Config{}, w, msg, p)
+			if applied != tt.wantApplied || drop != tt.wantDrop {
+				t.Fatalf("got applied %t drop %t, want %t %t", applied, drop, tt.wantApplied, tt.wantDrop)
+			}
+			if drop {
+				if w.reason != dropDenied {
+					t.Errorf("got drop reason %d, want %d", w.reason, dropDenied)
+				}
+				return
+			}
+
+			if msg.Rcode != tt.wantRcode {
+				t.Errorf("got rcode %s, want %s", dns.RcodeToString[msg.Rcode], dns.RcodeToString[tt.wantRcode])
+			}
+			if len(msg.Answer) != len(tt.wantAnswer) {
+				t.Fatalf("got answer %v, want %v", msg.Answer, tt.wantAnswer)
+			}
+			for i, rr := range msg.Answer {
+				if i == 0 && rr.Header().Name != "blocked.example." {
+					t.Errorf("got owner %s, want the query name", rr.Header().Name)
+				}
+
+				var got string
+				switch rr := rr.(type) {
+				case *dns.A:
+					got = rr.A.String()
+				case *dns.CNAME:
+					got = rr.Target
+				}
+				if got != tt.wantAnswer[i] {
+					t.Errorf("got answer %v, want %v", msg.Answer, tt.wantAnswer)
+				}
+			}
+		})
+	}
+}
+
+// testRR parses the record.
+func testRR(t *testing.T, s string) dns.RR {
+	t.Helper()
+
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return rr
+}
@@ -1,25 +1,33 @@
 package server
 
 import (
+	"errors"
 	"fmt"
+	"net"
 	"strings"
+	"time"
 
 	"github.com/miekg/dns"
 	"github.com/rs/zerolog/log"
 
 	"github.com/azrod/dnsr/internal/cache/base"
 	"github.com/azrod/dnsr/internal/config"
+	"github.com/azrod/dnsr/internal/metrics"
 )
 
 type (
 	DNSHandler struct {
 		Cache base.Cache
+		// Listener is the listener the handler serves, matched by the upstream listener conditions.
+		Listener string
 	}
 
 	DNSRequest struct {
-		msg               *dns.Msg
-		dnsServers        []string
-		defaultDNSServers []string
+		req       *dns.Msg
+		msg       *dns.Msg
+		upstreams []*config.Upstream
+		// timeout is the timeout of each attempt to the upstreams without their own.
+		timeout time.Duration
 	}
 )
 
@@ -34,11 +42,37 @@ func (h *DNSHandler) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
 	// Add special command in domain name
 	// For examples
 	// clear/domain.com will clear the cache for domain.com
+	// clear/AAAA/domain.com will clear the AAAA cache for domain.com
 	// clear/all
+	client := clientIP(w)
+
+	// The configuration may be reloaded while the request is served
+	cfg := config.Get()
+
 	switch {
+	case !cfg.Server.IsAllowed(client):
+		metrics.DeniedQueries.WithLabelValues(cfg.Server.GetDenyAction()).Inc()
+		if cfg.Server.GetDenyAction() == config.DenyDrop {
+			log.Debug().Msgf("Dropping request for %s from denied client %s", domain, w.RemoteAddr())
+			dropResponse(w, dropDenied)
+			return
+		}
+		log.Debug().Msgf("Refusing request for %s from denied client %s", domain, w.RemoteAddr())
+		msg.SetRcode(r, dns.RcodeRefused)
+	case !allowClient(cfg.Server.RateLimit, client):
+		log.Debug().Msgf("Dropping request for %s from rate limited client %s", domain, w.RemoteAddr())
+		dropResponse(w, dropRateLimited)
+		return
+	case cfg.Server.DisableDNSCommands && strings.HasPrefix(domain, "clear/"):
+		log.Warn().Msgf("Ignoring DNS command %s, DNS commands are disabled", domain)
+		msg.SetRcode(r, dns.RcodeRefused)
+	case strings.HasPrefix(domain, "clear/") && !cfg.Server.IsCommandAllowed(client):
+		log.Warn().Msgf("Ignoring DNS command %s from denied client %s", domain, w.RemoteAddr())
+		msg.SetRcode(r, dns.RcodeRefused)
 	case domain == "clear/all.":
 		if h.Cache != nil {
 			log.Info().Msg("Clearing all cache")
+			size := h.Cache.Len()
 			if err := h.Cache.Clear(); err != nil {
 				log.Error().Err(err).Msg("Error clearing cache")
 				msg.Answer = append(msg.Answer, &dns.TXT{
@@ -60,6 +94,7 @@ func (h *DNSHandler) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
 					},
 					Txt: []string{"Cache cleared"},
 				})
+				metrics.CacheDeletions.Add(float64(size))
 			}
 		} else {
 			msg.Answer = append(msg.Answer, &dns.TXT{
@@ -76,7 +111,7 @@ func (h *DNSHandler) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
 		domain = strings.TrimPrefix(domain, "clear/")
 		if h.Cache != nil {
 			log.Info().Msgf("Clearing cache for %s", domain)
-			if err := h.Cache.Delete(domain); err != nil {
+			if err := h.clearCache(domain); err != nil {
 				log.Error().Err(err).Msgf("Error clearing cache for %s", domain)
 				msg.Answer = append(msg.Answer, &dns.TXT{
 					Hdr: dns.RR_Header{
@@ -110,52 +145,319 @@ func (h *DNSHandler) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
 			})
 		}
 	default:
-		if h.Cache != nil && h.Cache.Exists(domain) && !h.Cache.HasExpired(domain) {
-			if value, err := h.Cache.Get(domain); err == nil {
-				log.Info().Msgf("Using cache for domain %s (Expire at %v)", domain, h.Cache.GetExpireAt(domain).Format("2006-01-02 15:04:05"))
-				msg.Answer = append(msg.Answer, value...)
+		// Local zones, static records and hosts files are answered before routing
+		if msg.Question[0].Qclass == dns.ClassINET {
+			if answer, ok := config.Lz.Lookup(domain, msg.Question[0].Qtype); ok {
+				log.Debug().Msgf("Using local data for %s", domain)
+				setFromLocal(&msg, answer)
+				// The CNAME chain leaving the local data is completed like the chains of the policies
+				if answer.Target != "" {
+					msg.Answer = append(msg.Answer, h.resolve(cfg, answer.Target, msg.Question[0].Qtype)...)
+				}
+				break
+			}
+			if answer, ok := config.Hosts.Lookup(domain, msg.Question[0].Qtype); ok {
+				log.Debug().Msgf("Using hosts files for %s", domain)
+				setFromLocal(&msg, answer)
+				break
+			}
+		}
+
+		if config.Bl.IsBlocked(domain) {
+			log.Info().Msgf("Blocking %s", domain)
+			metrics.BlockedQueries.Inc()
+			setBlocked(&msg, cfg.Blocklists)
+			break
+		}
+
+		// The query name policies are applied before resolution
+		policy := config.Rpz.MatchQName(domain)
+		if policy != nil {
+			applied, drop := h.enforcePolicy(cfg, w, &msg, policy)
+			if drop {
+				return
+			}
+			if applied {
+				break
 			}
+		}
+
+		// Define the upstream server to use, the names delegated by a local zone are sent to the name servers of the cut
+		var upstream *config.Upstream
+		if msg.Question[0].Qclass == dns.ClassINET {
+			upstream = h.delegation(cfg, domain, msg.Question[0].Qtype)
+		}
+		if upstream == nil {
+			upstream = config.Md.Get(config.Query{
+				Name:     domain,
+				Qtype:    msg.Question[0].Qtype,
+				Client:   client,
+				Listener: h.listener(w),
+			})
+		}
+
+		// The answers of the upstreams depending on the client are cached apart from the others
+		key := base.NewKey(msg.Question[0])
+		if upstream != nil {
+			key.Upstream = upstream.CacheID()
+		}
+
+		var (
+			value  base.CacheValue
+			cached bool
+		)
+		if h.Cache != nil {
+			value, cached = h.Cache.Lookup(key)
+		}
+
+		if cached && !value.HasExpired() {
+			metrics.CacheHits.Inc()
+			log.Info().Msgf("Using cache for %s (Expire at %v)", key, value.ExpireAt.Format("2006-01-02 15:04:05"))
+			setFromCache(&msg, value)
 		} else {
+			if h.Cache != nil {
+				metrics.CacheMisses.Inc()
+			}
+
 			dr := DNSRequest{
-				msg:               &msg,
-				defaultDNSServers: config.Cfg.Server.DefaultUpstream,
+				req:     r,
+				msg:     &msg,
+				timeout: cfg.Server.GetUpstreamTimeout(),
 			}
 
 			// Send the request to the upstream server
-			// Define the upstream server to use
-			if dnsServers := config.Md.Get(domain); dnsServers != nil {
-				dr.dnsServers = dnsServers
+			if upstream != nil {
+				dr.upstreams = append(dr.upstreams, upstream)
 			}
+			dr.upstreams = append(dr.upstreams, cfg.Server.GetDefaultUpstream())
 
-			// Forward the request
-			switch dr.Forward(domain) {
-			case dns.RcodeSuccess:
-				msg.Answer = dr.msg.Answer
-				if h.Cache != nil && len(msg.Answer) > 0 {
-					log.Info().Msgf("Caching response for %s", domain)
-					if err := h.Cache.Set(domain, msg.Answer); err != nil {
-						log.Error().Err(err).Msg("Error writing in cache")
-					}
+			if stale := cfg.Cache.ServeStale; cached && value.IsStale(stale.GetWindow()) {
+				// The expired entry is answered when the upstreams fail or do not answer in time
+				if resp := h.forwardStale(dr, key, domain, stale.GetClientTimeout()); resp != nil {
+					msg = *resp
+				} else {
+					log.Info().Msgf("Using stale cache for %s (Expired at %v)", key, value.ExpireAt.Format("2006-01-02 15:04:05"))
+					metrics.CacheStale.Inc()
+					setStale(&msg, value, stale.GetTTL())
 				}
-			case dns.RcodeServerFailure:
-				// Special case trying get value from cache even if ttl has expired
-				if h.Cache != nil && h.Cache.Exists(domain) && !h.Cache.HasExpired(domain) {
-					if value, err := h.Cache.Get(domain); err == nil {
-						log.Debug().Msgf("Cache hit for %s", domain)
-						msg.Answer = append(msg.Answer, value...)
+			} else {
+				// Forward the request
+				switch dr.Forward(domain) {
+				case dns.RcodeSuccess, dns.RcodeNameError:
+					if h.Cache != nil {
+						h.cacheResponse(key, &msg)
 					}
-				} else {
+				case dns.RcodeServerFailure:
 					// If we get here, none of the default upstream servers responded
 					// Send a SERVFAIL response
 					msg.SetRcode(r, dns.RcodeServerFailure)
 				}
-			default:
-				msg.Answer = dr.msg.Answer
 			}
 		}
+
+		// The response policies are applied to the answers, unless a passthru policy matched the query name
+		if policy == nil && msg.Rcode == dns.RcodeSuccess {
+			if p := h.matchResponsePolicy(cfg, &msg); p != nil {
+				if _, drop := h.enforcePolicy(cfg, w, &msg, p); drop {
+					return
+				}
+			}
+		}
+	}
+
+	// Responses too large for the client UDP buffer are truncated
+	// so that the client retries over TCP
+	if w.LocalAddr().Network() == "udp" {
+		// Identical UDP responses are limited, TCP clients can not be spoofed
+		if rrl := cfg.Server.RRL; rrl.Enabled && client != nil {
+			send, slipped := limitResponse(rrl, rrl.Prefix(client), &msg)
+			switch {
+			case !send:
+				log.Debug().Msgf("Dropping response for %s to %s, response rate limit exceeded", domain, w.RemoteAddr())
+				metrics.RateLimited.WithLabelValues(metrics.LimitResponse, metrics.ActionDrop).Inc()
+				return
+			case slipped:
+				metrics.RateLimited.WithLabelValues(metrics.LimitResponse, metrics.ActionSlip).Inc()
+			}
+		}
+
+		size := dns.MinMsgSize
+		if opt := r.IsEdns0(); opt != nil {
+			size = int(opt.UDPSize())
+		}
+		msg.Truncate(size)
 	}
 
+	metrics.Queries.WithLabelValues(dns.TypeToString[r.Question[0].Qtype], dns.RcodeToString[msg.Rcode]).Inc()
+
 	if writeErr := w.WriteMsg(&msg); writeErr != nil {
 		log.Error().Err(writeErr).Msg("Error writing response")
 	}
 }
+
+// dropReason is the reason a request is dropped without a response.
+type dropReason int
+
+const (
+	// dropDenied is a request of a denied client or matching a DROP policy.
+	dropDenied dropReason = iota + 1
+	// dropRateLimited is a request over the rate limit of the client.
+	dropRateLimited
+)
+
+// dropper is implemented by the response writers of the clients that must be told a request is dropped.
+type dropper interface {
+	// Drop reports that no DNS response is sent on purpose.
+	Drop(reason dropReason)
+}
+
+// dropResponse reports that the request is dropped on purpose. The DNS clients get no response,
+// the DNS-over-HTTPS clients get an HTTP status matching the reason instead of a server error.
+func dropResponse(w dns.ResponseWriter, reason dropReason) {
+	if d, ok := w.(dropper); ok {
+		d.Drop(reason)
+	}
+}
+
+// allowClient applies the rate limit of the client prefix.
+func allowClient(rl config.RateLimit, client net.IP) bool {
+	if !rl.Enabled || client == nil {
+		return true
+	}
+
+	if ok, _ := clientLimiter.allow(rl.Prefix(client), rl.QueriesPerSecond, rl.GetBurst()); !ok {
+		metrics.RateLimited.WithLabelValues(metrics.LimitClient, metrics.ActionDrop).Inc()
+		return false
+	}
+
+	return true
+}
+
+// WithListener returns a copy of the handler serving the given listener, the cache is shared.
+func (h *DNSHandler) WithListener(listener string) *DNSHandler {
+	return &DNSHandler{
+		Cache:    h.Cache,
+		Listener: listener,
+	}
+}
+
+// listener returns the listener the query was received on.
+// Without an explicit listener, it is deduced from the network of the connection.
+func (h *DNSHandler) listener(w dns.ResponseWriter) string {
+	if h.Listener != "" {
+		return h.Listener
+	}
+
+	if w.LocalAddr().Network() == "udp" {
+		return config.ListenerUDP
+	}
+
+	return config.ListenerTCP
+}
+
+// clientIP returns the address of the client, or nil if it can not be parsed.
+func clientIP(w dns.ResponseWriter) net.IP {
+	host, _, err := net.SplitHostPort(w.RemoteAddr().String())
+	if err != nil {
+		return nil
+	}
+
+	return net.ParseIP(host)
+}
+
+// cacheResponse caches the upstream response of the given key.
+// NXDOMAIN and NODATA answers are cached for the negative TTL of their SOA record (RFC 2308).
+func (h *DNSHandler) cacheResponse(key base.Key, msg *dns.Msg) {
+	var err error
+
+	switch {
+	case msg.Rcode == dns.RcodeSuccess && len(msg.Answer) > 0:
+		log.Info().Msgf("Caching response for %s", key)
+		err = h.Cache.Set(key, msg.Answer)
+	default:
+		log.Info().Msgf("Caching negative response (%s) for %s", dns.RcodeToString[msg.Rcode], key)
+		err = h.Cache.SetNegative(key, msg.Rcode, msg.Answer, msg.Ns)
+	}
+
+	switch {
+	case errors.Is(err, base.ErrNoSOA):
+		log.Debug().Msgf("Not caching negative response for %s: %v", key, err)
+	case errors.Is(err, base.ErrTooLarge):
+		log.Debug().Msgf("Not caching response for %s: %v", key, err)
+	case err != nil:
+		log.Error().Err(err).Msg("Error writing in cache")
+	}
+}
+
+// setFromCache fills the response with a cached entry.
+func setFromCache(msg *dns.Msg, value base.CacheValue) {
+	msg.Rcode = value.Rcode
+	msg.Answer = append(msg.Answer, value.Value...)
+	msg.Ns = append(msg.Ns, value.Ns...)
+}
+
+// setFromLocal fills the response with an answer from the local data.
+func setFromLocal(msg *dns.Msg, answer config.LocalAnswer) {
+	msg.Rcode = answer.Rcode
+	msg.Authoritative = answer.Authoritative
+	msg.Answer = append(msg.Answer, answer.Answer...)
+	msg.Ns = append(msg.Ns, answer.Ns...)
+}
+
+// setBlocked fills the response with the configured block response.
+// The null and custom responses have no data for the types other than A and AAAA.
+func setBlocked(msg *dns.Msg, b config.Blocklists) {
+	q := msg.Question[0]
+	hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: b.GetTTL()}
+
+	var ips []net.IP
+	switch b.GetResponse() {
+	case config.BlockNXDomain:
+		msg.Rcode = dns.RcodeNameError
+		return
+	case config.BlockRefused:
+		msg.Rcode = dns.RcodeRefused
+		return
+	case config.BlockNull:
+		ips = []net.IP{net.IPv4zero, net.IPv6zero}
+	case config.BlockCustom:
+		for _, ip := range b.IPs {
+			ips = append(ips, net.ParseIP(ip))
+		}
+	}
+
+	for _, ip := range ips {
+		switch ip4 := ip.To4(); {
+		case q.Qtype == dns.TypeA && ip4 != nil:
+			msg.Answer = append(msg.Answer, &dns.A{Hdr: hdr, A: ip4})
+		case q.Qtype == dns.TypeAAAA && ip4 == nil:
+			msg.Answer = append(msg.Answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+		}
+	}
+}
+
+// clearCache clears the cache entries targeted by a clear/ command.
+// The target is either "<domain>" to clear every type of the domain or
+// "<type>/<domain>" to clear a single type of the domain.
+func (h *DNSHandler) clearCache(target string) error {
+	size := h.Cache.Len()
+	defer func() {
+		metrics.CacheDeletions.Add(float64(size - h.Cache.Len()))
+	}()
+
+	qtype, name, found := strings.Cut(target, "/")
+	if !found {
+		return h.Cache.DeleteName(target)
+	}
+
+	t, ok := dns.StringToType[strings.ToUpper(qtype)]
+	if !ok {
+		return fmt.Errorf("unknown type %q", qtype)
+	}
+
+	if base.DeleteQuestion(h.Cache, base.NewKey(dns.Question{Name: name, Qtype: t, Qclass: dns.ClassINET})) == 0 {
+		return base.ErrNotFound
+	}
+
+	return nil
+}
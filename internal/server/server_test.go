@@ -0,0 +1,225 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/azrod/dnsr/internal/cache/base"
+	"github.com/azrod/dnsr/internal/cache/memory"
+	"github.com/azrod/dnsr/internal/config"
+)
+
+// testResponseWriter records the response written to a UDP client.
+type testResponseWriter struct {
+	msg *dns.Msg
+}
+
+func (w *testResponseWriter) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+}
+
+func (w *testResponseWriter) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}
+}
+
+func (w *testResponseWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+func (w *testResponseWriter) Write([]byte) (int, error) { return 0, nil }
+func (w *testResponseWriter) Close() error              { return nil }
+func (w *testResponseWriter) TsigStatus() error         { return nil }
+func (w *testResponseWriter) TsigTimersOnly(bool)       {}
+func (w *testResponseWriter) Hijack()                   {}
+
+// startTestUpstream starts a UDP DNS server answering with the handler and returns its address.
+func startTestUpstream(t *testing.T, handler dns.HandlerFunc) string {
+	t.Helper()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	started := make(chan struct{})
+	srv := &dns.Server{PacketConn: pc, Handler: handler, NotifyStartedFunc: func() { close(started) }}
+	go func() {
+		_ = srv.ActivateAndServe()
+	}()
+	<-started
+	t.Cleanup(func() { _ = srv.Shutdown() })
+
+	return pc.LocalAddr().String()
+}
+
+// writeTestConfig writes the configuration file and reads it.
+func writeTestConfig(t *testing.T, file, content string) {
+	t.Helper()
+
+	if err := os.WriteFile(file, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := config.ReadConfig(file); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServeDNSConfigReload(t *testing.T) {
+	upstream := startTestUpstream(t, answerA)
+	file := filepath.Join(t.TempDir(), "config.yaml")
+
+	configs := []string{
+		fmt.Sprintf("server:\n  defaultUpstream: [%s]\n", upstream),
+		fmt.Sprintf("server:\n  defaultUpstream: [%s]\n  rateLimit:\n    enabled: true\n    queriesPerSecond: 100000\nupstreams:\n  - name: example\n    servers: [%s]\n    suffixes: [example.com]\n", upstream, upstream),
+	}
+	writeTestConfig(t, file, configs[0])
+
+	h := &DNSHandler{}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			if err := os.WriteFile(file, []byte(configs[i%len(configs)]), 0o600); err != nil {
+				t.Error(err)
+				return
+			}
+			if err := config.ReadConfig(file); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				w := &testResponseWriter{}
+				h.ServeDNS(w, testQuery())
+				if w.msg == nil || w.msg.Rcode != dns.RcodeSuccess || len(w.msg.Answer) != 1 {
+					t.Errorf("got %v, want NOERROR with 1 answer", w.msg)
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+}
+
+func TestServeDNSLocalCNAME(t *testing.T) {
+	upstream := startTestUpstream(t, answerA)
+	writeTestConfig(t, filepath.Join(t.TempDir(), "config.yaml"), fmt.Sprintf(`server:
+  defaultUpstream: [%s]
+zones:
+  - name: lan
+    records:
+      - "www 300 IN CNAME www.example.com."
+`, upstream))
+
+	q := new(dns.Msg)
+	q.SetQuestion("www.lan.", dns.TypeA)
+
+	w := &testResponseWriter{}
+	(&DNSHandler{}).ServeDNS(w, q)
+
+	if w.msg == nil || w.msg.Rcode != dns.RcodeSuccess {
+		t.Fatalf("got %v, want NOERROR", w.msg)
+	}
+	if len(w.msg.Answer) != 2 || w.msg.Answer[0].Header().Rrtype != dns.TypeCNAME || w.msg.Answer[1].Header().Rrtype != dns.TypeA {
+		t.Errorf("got answer %v, want the CNAME followed by the A record of its target", w.msg.Answer)
+	}
+}
+
+func TestDelegation(t *testing.T) {
+	writeTestConfig(t, filepath.Join(t.TempDir(), "config.yaml"), `zones:
+  - name: lan
+    records:
+      - "host 300 IN A 192.168.1.10"
+      - "sub 300 IN NS ns1.sub"
+      - "sub 300 IN NS host"
+      - "ns1.sub 300 IN A 192.168.1.53"
+`)
+
+	tests := []struct {
+		name  string
+		qname string
+		want  []string
+	}{
+		{name: "below cut", qname: "www.sub.lan.", want: []string{"192.168.1.53:53", "192.168.1.10:53"}},
+		{name: "not delegated", qname: "host.lan."},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := (&DNSHandler{}).delegation(config.Get(), tt.qname, dns.TypeA)
+			if u == nil {
+				if tt.want != nil {
+					t.Fatalf("got no delegation, want %v", tt.want)
+				}
+				return
+			}
+
+			if !slices.Equal(u.DNSServers, tt.want) {
+				t.Errorf("got servers %v, want %v", u.DNSServers, tt.want)
+			}
+		})
+	}
+}
+
+func TestServeDNSNegativeCNAMECached(t *testing.T) {
+	var queries atomic.Int32
+	upstream := startTestUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		queries.Add(1)
+
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeNameError)
+		m.Answer = []dns.RR{&dns.CNAME{
+			Hdr:    dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 300},
+			Target: "missing.example.net.",
+		}}
+		m.Ns = []dns.RR{&dns.SOA{
+			Hdr:    dns.RR_Header{Name: "example.net.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 300},
+			Ns:     "ns.example.net.",
+			Mbox:   "hostmaster.example.net.",
+			Minttl: 300,
+		}}
+		_ = w.WriteMsg(m)
+	})
+	writeTestConfig(t, filepath.Join(t.TempDir(), "config.yaml"), fmt.Sprintf("server:\n  defaultUpstream: [%s]\n", upstream))
+
+	c, err := memory.New(base.Options{MaxNegativeTTL: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &DNSHandler{Cache: c}
+
+	for i := 0; i < 2; i++ {
+		w := &testResponseWriter{}
+		h.ServeDNS(w, testQuery())
+
+		if w.msg == nil || w.msg.Rcode != dns.RcodeNameError {
+			t.Fatalf("query %d: got %v, want NXDOMAIN", i, w.msg)
+		}
+		if len(w.msg.Answer) != 1 || w.msg.Answer[0].Header().Rrtype != dns.TypeCNAME {
+			t.Errorf("query %d: got answer %v, want the CNAME record", i, w.msg.Answer)
+		}
+	}
+
+	if n := queries.Load(); n != 1 {
+		t.Errorf("got %d upstream queries, want 1", n)
+	}
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rs/zerolog/log"
+
+	"github.com/azrod/dnsr/internal/cache/base"
+)
+
+// staleRefreshInterval is the time stale data is answered without querying the upstreams
+// after a failed refresh (RFC 8767 section 5).
+const staleRefreshInterval = 30 * time.Second
+
+// staleRefreshes holds the stale entries being refreshed or whose refresh failed recently.
+var staleRefreshes = &staleRefresher{
+	next: make(map[base.Key]time.Time),
+}
+
+// staleRefresher prevents concurrent refreshes of a stale entry.
+type staleRefresher struct {
+	mu sync.Mutex
+	// next is the time the next refresh of an entry may start, zero while a refresh is running.
+	next map[base.Key]time.Time
+}
+
+// start returns true and marks the entry as being refreshed if no refresh is running or failed recently.
+func (s *staleRefresher) start(key base.Key) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if next, ok := s.next[key]; ok && (next.IsZero() || time.Now().Before(next)) {
+		return false
+	}
+	s.next[key] = time.Time{}
+
+	return true
+}
+
+// done ends the refresh of the entry. A failed refresh delays the next one.
+func (s *staleRefresher) done(key base.Key, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if ok {
+		delete(s.next, key)
+		return
+	}
+
+	now := time.Now()
+	s.next[key] = now.Add(staleRefreshInterval)
+
+	// The failures are rare, the delays elapsed are removed with them
+	for k, next := range s.next {
+		if !next.IsZero() && now.After(next) {
+			delete(s.next, k)
+		}
+	}
+}
+
+// forwardStale forwards the request of a stale cache entry and returns the response
+// if the upstreams answer in time, nil if the stale entry must be answered.
+// The resolution goes on in the background after the client timeout to refresh the entry.
+func (h *DNSHandler) forwardStale(dr DNSRequest, key base.Key, domain string, clientTimeout time.Duration) *dns.Msg {
+	if !staleRefreshes.start(key) {
+		log.Debug().Msgf("Not refreshing stale cache for %s, a refresh is running or failed recently", key)
+		return nil
+	}
+
+	// The response of a refresh finishing in the background must not be written in the client response
+	msg := dr.msg.Copy()
+	dr.msg = msg
+
+	done := make(chan bool, 1)
+	go func() {
+		switch dr.Forward(domain) {
+		case dns.RcodeSuccess, dns.RcodeNameError:
+			h.cacheResponse(key, msg)
+			staleRefreshes.done(key, true)
+			done <- true
+		default:
+			staleRefreshes.done(key, false)
+			done <- false
+		}
+	}()
+
+	select {
+	case ok := <-done:
+		if ok {
+			return msg
+		}
+	case <-time.After(clientTimeout):
+		log.Debug().Msgf("Upstreams did not answer in time for %s, refreshing in the background", key)
+	}
+
+	return nil
+}
+
+// setStale fills the response with an expired cache entry, with the TTL of the stale answers.
+func setStale(msg *dns.Msg, value base.CacheValue, ttl uint32) {
+	value.Value = base.WithTTL(value.Value, ttl)
+	value.Ns = base.WithTTL(value.Ns, ttl)
+
+	setFromCache(msg, value)
+}
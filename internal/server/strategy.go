@@ -0,0 +1,139 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rs/zerolog/log"
+
+	"github.com/azrod/dnsr/internal/config"
+	"github.com/azrod/dnsr/internal/metrics"
+)
+
+// roundRobinCounters holds the round-robin position of each list of servers.
+var roundRobinCounters sync.Map
+
+// isFinal returns true if the answer is positive or negative, the other servers would return the same.
+func isFinal(r *dns.Msg) bool {
+	return r != nil && (r.Rcode == dns.RcodeSuccess || r.Rcode == dns.RcodeNameError)
+}
+
+// exchangeUpstream sends the request to the servers of the upstream with its strategy.
+// The attempts time out after the timeout of the upstream, or after timeout if it has none.
+// It returns the first final answer, or the last answer received if none is final.
+func exchangeUpstream(u *config.Upstream, timeout time.Duration, m *dns.Msg, domain string) (result *dns.Msg) {
+	// Unhealthy servers are skipped
+	servers := healthyServers(u.DNSServers)
+	timeout = u.GetTimeout(timeout)
+
+	if u.GetStrategy() == config.StrategyParallel {
+		return exchangeParallel(servers, timeout, m, domain)
+	}
+
+	for _, server := range orderServers(servers, u.GetStrategy()) {
+		r := exchange(server, timeout, m, domain)
+		if isFinal(r) {
+			return r
+		}
+		if r != nil {
+			result = r
+		}
+	}
+
+	return result
+}
+
+// exchangeParallel sends the request to all the servers at once and returns the first final answer.
+func exchangeParallel(servers []string, timeout time.Duration, m *dns.Msg, domain string) (result *dns.Msg) {
+	results := make(chan *dns.Msg, len(servers))
+	for _, server := range servers {
+		go func(server string) {
+			// Each goroutine works on its own copy, the message is modified when packed
+			results <- exchange(server, timeout, m.Copy(), domain)
+		}(server)
+	}
+
+	for range servers {
+		r := <-results
+		if isFinal(r) {
+			return r
+		}
+		if r != nil {
+			result = r
+		}
+	}
+
+	return result
+}
+
+// exchange sends the request to a single server.
+func exchange(server string, timeout time.Duration, m *dns.Msg, domain string) *dns.Msg {
+	u, err := getUpstream(server)
+	if err != nil {
+		log.Error().Err(err).Msg("Error getting upstream")
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	metrics.UpstreamRequests.WithLabelValues(server).Inc()
+
+	upstreamResponse, timeD, err := u.Exchange(ctx, m)
+	if err != nil {
+		log.Error().Msgf("Error getting upstream response from %s: %v", server, err)
+		metrics.UpstreamErrors.WithLabelValues(server).Inc()
+		recordFailure(server, timeout)
+		return nil
+	}
+
+	metrics.UpstreamDuration.WithLabelValues(server).Observe(timeD.Seconds())
+
+	// A SERVFAIL is an answer about the domain, the server itself is reachable
+	if upstreamResponse.Rcode == dns.RcodeServerFailure {
+		metrics.UpstreamErrors.WithLabelValues(server).Inc()
+	}
+	recordSuccess(server, timeD)
+
+	if isFinal(upstreamResponse) {
+		log.Info().Msgf("Sending request to %s for %s took %v", server, domain, timeD)
+	} else {
+		log.Warn().Msgf("Upstream %s returned %s for %s", server, dns.RcodeToString[upstreamResponse.Rcode], domain)
+	}
+
+	return upstreamResponse
+}
+
+// orderServers returns the servers in the order they are tried with the given strategy.
+func orderServers(servers []string, strategy string) []string {
+	if len(servers) < 2 {
+		return servers
+	}
+
+	ordered := slices.Clone(servers)
+
+	switch strategy {
+	case config.StrategyRoundRobin:
+		c, _ := roundRobinCounters.LoadOrStore(strings.Join(servers, ","), new(atomic.Uint64))
+		start := int(c.(*atomic.Uint64).Add(1) % uint64(len(servers)))
+		ordered = append(ordered[start:], ordered[:start]...)
+	case config.StrategyRandom:
+		rand.Shuffle(len(ordered), func(i, j int) {
+			ordered[i], ordered[j] = ordered[j], ordered[i]
+		})
+	case config.StrategyLowestLatency:
+		// Servers never measured have no latency and are tried first
+		slices.SortStableFunc(ordered, func(a, b string) int {
+			return cmp.Compare(getLatency(a), getLatency(b))
+		})
+	}
+
+	return ordered
+}
@@ -0,0 +1,273 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rs/zerolog/log"
+
+	"github.com/azrod/dnsr/internal/config"
+)
+
+type (
+	// upstream is a DNS server the requests are forwarded to.
+	upstream interface {
+		// Exchange sends the request to the upstream and returns its response.
+		// The request is aborted when the context deadline is exceeded.
+		Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, time.Duration, error)
+	}
+
+	// plainUpstream is a DNS server reached over UDP, with a fallback to TCP for truncated answers.
+	plainUpstream struct {
+		addr      string
+		udpClient *dns.Client
+		tcpClient *dns.Client
+	}
+
+	// tlsUpstream is a DNS-over-TLS server (RFC 7858).
+	// The connections are kept open and reused by the next requests, to avoid a TLS handshake per request.
+	tlsUpstream struct {
+		addr   string
+		client *dns.Client
+
+		mu sync.Mutex
+		// idle holds the open connections not used by a request, the most recently used last.
+		idle []*idleConn
+	}
+
+	// idleConn is an open connection and the time it was last used.
+	idleConn struct {
+		conn *dns.Conn
+		used time.Time
+	}
+)
+
+const (
+	// tlsMaxIdleConns is the maximum number of open connections kept per DNS-over-TLS server.
+	tlsMaxIdleConns = 8
+	// tlsIdleTimeout is the time after which an unused connection is closed,
+	// servers close the idle connections themselves after a few seconds (RFC 7766 section 6.2.3).
+	tlsIdleTimeout = 10 * time.Second
+)
+
+// upstreams holds the upstreams already built, by address.
+var upstreams sync.Map
+
+// getUpstream returns the upstream for the given address.
+// Addresses are either host:port for plain DNS or URLs like tls://1.1.1.1:853#cloudflare-dns.com
+// and https://dns.example/dns-query.
+func getUpstream(addr string) (upstream, error) {
+	if u, ok := upstreams.Load(addr); ok {
+		return u.(upstream), nil
+	}
+
+	u, err := newUpstream(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	actual, _ := upstreams.LoadOrStore(addr, u)
+	return actual.(upstream), nil
+}
+
+// newUpstream builds the upstream for the given address.
+func newUpstream(addr string) (upstream, error) {
+	if !strings.Contains(addr, "://") {
+		return &plainUpstream{
+			addr:      addr,
+			udpClient: new(dns.Client),
+			tcpClient: &dns.Client{Net: "tcp"},
+		}, nil
+	}
+
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream %s: %w", addr, err)
+	}
+
+	switch u.Scheme {
+	case config.SchemeTLS:
+		return newTLSUpstream(u)
+	case config.SchemeHTTPS:
+		return newDoHUpstream(addr), nil
+	default:
+		return nil, fmt.Errorf("unsupported scheme %q for upstream %s", u.Scheme, addr)
+	}
+}
+
+// Exchange sends the request over UDP and retries over TCP if the answer is truncated.
+func (u *plainUpstream) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, time.Duration, error) {
+	r, rtt, err := u.udpClient.ExchangeContext(ctx, m, u.addr)
+	if err == nil && r.Truncated {
+		// The answer does not fit in a UDP message, retry over TCP
+		log.Debug().Msgf("Truncated response from %s, retrying over TCP", u.addr)
+		return u.tcpClient.ExchangeContext(ctx, m, u.addr)
+	}
+
+	return r, rtt, err
+}
+
+// defaultTLSPort is the default port of DNS-over-TLS servers.
+const defaultTLSPort = "853"
+
+// newTLSUpstream builds a DNS-over-TLS upstream from an URL like
+// tls://1.1.1.1:853?ca=/path/ca.pem&spki=<base64 sha256>#cloudflare-dns.com.
+// The fragment is the server name used for SNI and certificate verification.
+// The optional ca query parameter is a PEM bundle to verify the certificate with
+// instead of the system pool, and spki pins the SHA-256 of the server public key.
+func newTLSUpstream(u *url.URL) (*tlsUpstream, error) {
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), defaultTLSPort)
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: u.Fragment,
+		// The new connections resume the TLS sessions of the previous ones
+		ClientSessionCache: tls.NewLRUClientSessionCache(0),
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = u.Hostname()
+	}
+
+	if ca := u.Query().Get("ca"); ca != "" {
+		pem, err := os.ReadFile(ca)
+		if err != nil {
+			return nil, fmt.Errorf("error reading CA of upstream %s: %w", u.Redacted(), err)
+		}
+
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in CA %s of upstream %s", ca, u.Redacted())
+		}
+	}
+
+	if pins := u.Query()["spki"]; len(pins) > 0 {
+		verify, err := verifySPKIPins(pins)
+		if err != nil {
+			return nil, fmt.Errorf("upstream %s: %w", u.Redacted(), err)
+		}
+		tlsConfig.VerifyPeerCertificate = verify
+	}
+
+	return &tlsUpstream{
+		addr: addr,
+		client: &dns.Client{
+			Net:       "tcp-tls",
+			TLSConfig: tlsConfig,
+		},
+	}, nil
+}
+
+// Exchange sends the request over TLS, on an open connection if there is one.
+func (u *tlsUpstream) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, time.Duration, error) {
+	if conn := u.getConn(); conn != nil {
+		r, rtt, err := u.client.ExchangeWithConnContext(ctx, m, conn)
+		if err == nil {
+			u.putConn(conn)
+			return r, rtt, nil
+		}
+
+		// The server may have closed the connection, the request is sent again on a new one
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, rtt, err
+		}
+		log.Debug().Err(err).Msgf("Error on open connection to %s, retrying on a new connection", u.addr)
+	}
+
+	conn, err := u.client.DialContext(ctx, u.addr)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	r, rtt, err := u.client.ExchangeWithConnContext(ctx, m, conn)
+	if err != nil {
+		// A late response must not be read by the next request
+		conn.Close()
+		return nil, rtt, err
+	}
+
+	u.putConn(conn)
+	return r, rtt, nil
+}
+
+// getConn returns the most recently used open connection, or nil if there is none.
+// The connections unused for too long are closed.
+func (u *tlsUpstream) getConn() *dns.Conn {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	for len(u.idle) > 0 {
+		ic := u.idle[len(u.idle)-1]
+		u.idle = u.idle[:len(u.idle)-1]
+
+		if time.Since(ic.used) < tlsIdleTimeout {
+			return ic.conn
+		}
+		ic.conn.Close()
+	}
+
+	return nil
+}
+
+// putConn keeps the connection open for the next requests, or closes it when enough connections are open.
+func (u *tlsUpstream) putConn(conn *dns.Conn) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if len(u.idle) >= tlsMaxIdleConns {
+		conn.Close()
+		return
+	}
+
+	u.idle = append(u.idle, &idleConn{conn: conn, used: time.Now()})
+}
+
+// errSPKIPinMismatch is returned when no certificate of the chain matches the pinned public keys.
+var errSPKIPinMismatch = errors.New("no certificate matches the pinned public keys")
+
+// verifySPKIPins returns a certificate verifier checking that a certificate
+// of the chain has a public key whose SHA-256 is one of the base64 pins.
+func verifySPKIPins(pins []string) (func([][]byte, [][]*x509.Certificate) error, error) {
+	hashes := make([][]byte, len(pins))
+	for i, pin := range pins {
+		h, err := base64.StdEncoding.DecodeString(pin)
+		if err != nil || len(h) != sha256.Size {
+			return nil, fmt.Errorf("invalid spki pin %q", pin)
+		}
+		hashes[i] = h
+	}
+
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		for _, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return err
+			}
+
+			sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+			for _, h := range hashes {
+				if bytes.Equal(sum[:], h) {
+					return nil
+				}
+			}
+		}
+
+		return errSPKIPinMismatch
+	}, nil
+}